@@ -0,0 +1,72 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package pushtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scripted APNs failures.
+var (
+	APNsBadDeviceToken       = Reply{Status: http.StatusBadRequest, Reason: "BadDeviceToken"}
+	APNsUnregistered         = Reply{Status: http.StatusGone, Reason: "Unregistered"}
+	APNsInvalidProviderToken = Reply{Status: http.StatusForbidden, Reason: "InvalidProviderToken"}
+	APNsTooManyRequests      = Reply{Status: http.StatusTooManyRequests, Reason: "TooManyRequests"}
+	APNsInternalServerError  = Reply{Status: http.StatusInternalServerError, Reason: "InternalServerError"}
+)
+
+// APNs is a fake of the APNs provider API.
+type APNs struct {
+	*server
+}
+
+// NewAPNs starts a fake APNs. It must be closed once done.
+func NewAPNs() *APNs {
+	a := &APNs{}
+	a.server = newServer(http.HandlerFunc(a.handle))
+	return a
+}
+
+// handle serves pushes to a device, and broadcasts to a channel. The
+// Request of a broadcast has the channel id as its DeviceToken.
+func (a *APNs) handle(w http.ResponseWriter, r *http.Request) {
+	deviceToken, ok := strings.CutPrefix(r.URL.Path, "/3/device/")
+	if strings.HasPrefix(r.URL.Path, "/4/broadcasts/apps/") {
+		deviceToken, ok = r.Header.Get("apns-channel-id"), true
+	}
+	if r.Method != http.MethodPost || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	reply, ok := a.record(r, Request{DeviceToken: deviceToken, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	if !ok {
+		return
+	}
+
+	apnsID := r.Header.Get("apns-id")
+	if apnsID == "" {
+		apnsID = "00000000-0000-0000-0000-000000000000"
+	}
+	w.Header().Set("apns-id", apnsID)
+	if reply.Status == 0 || reply.Status == http.StatusOK {
+		return
+	}
+
+	resp := map[string]any{"reason": reply.Reason}
+	if reply.Status == http.StatusGone {
+		resp["timestamp"] = time.Now().UnixMilli()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reply.Status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
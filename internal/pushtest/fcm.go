@@ -0,0 +1,164 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package pushtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Scripted FCM failures.
+var (
+	FCMInvalidArgument  = Reply{Status: http.StatusBadRequest, Reason: "INVALID_ARGUMENT"}
+	FCMUnregistered     = Reply{Status: http.StatusNotFound, Reason: "UNREGISTERED"}
+	FCMSenderIDMismatch = Reply{Status: http.StatusForbidden, Reason: "SENDER_ID_MISMATCH"}
+	FCMThirdPartyAuth   = Reply{Status: http.StatusUnauthorized, Reason: "THIRD_PARTY_AUTH_ERROR"}
+	FCMQuotaExceeded    = Reply{Status: http.StatusTooManyRequests, Reason: "QUOTA_EXCEEDED"}
+	FCMInternal         = Reply{Status: http.StatusInternalServerError, Reason: "INTERNAL"}
+	FCMUnavailable      = Reply{Status: http.StatusServiceUnavailable, Reason: "UNAVAILABLE"}
+)
+
+// FCM_ACCESS_TOKEN is the access token the fake FCM hands out and expects.
+const FCM_ACCESS_TOKEN = "pushtest-access-token"
+
+// grpcStatuses are the statuses FCM reports along with HTTP status codes.
+var grpcStatuses = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusInternalServerError: "INTERNAL",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+}
+
+// FCM is a fake of the FCM HTTP v1 API, along with the OAuth token endpoint
+// of Google service accounts.
+type FCM struct {
+	*server
+}
+
+// NewFCM starts a fake FCM. It must be closed once done.
+func NewFCM() *FCM {
+	f := &FCM{}
+	f.server = newServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+// Endpoint returns the FCM endpoint to send notifications to.
+func (f *FCM) Endpoint() string {
+	return f.URL() + "/v1"
+}
+
+// ServiceAccountFile writes a service account file for projectID, whose
+// access tokens are requested from the fake, and returns its path.
+func (f *FCM) ServiceAccountFile(projectID string) (string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   projectID,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		"client_email": "pushtest@" + projectID + ".iam.gserviceaccount.com",
+		"token_uri":    f.URL() + "/token",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(f.dir, "service-account-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(buf); err != nil {
+		return "", err
+	}
+	return filepath.Clean(file.Name()), nil
+}
+
+func (f *FCM) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/token" {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": FCM_ACCESS_TOKEN,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		return
+	}
+
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/v1/projects/") || !strings.HasSuffix(r.URL.Path, "/messages:send") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+FCM_ACCESS_TOKEN {
+		writeFCMError(w, Reply{Status: http.StatusUnauthorized}, "missing or invalid access token")
+		return
+	}
+
+	var body struct {
+		Message json.RawMessage `json:"message"`
+	}
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(buf, &body); err != nil {
+		writeFCMError(w, FCMInvalidArgument, err.Error())
+		return
+	}
+	var message struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(body.Message, &message)
+
+	reply, ok := f.record(r, Request{DeviceToken: message.Token, Path: r.URL.Path, Header: r.Header.Clone(), Body: body.Message})
+	if !ok {
+		return
+	}
+	if reply.Status == 0 || reply.Status == http.StatusOK {
+		project := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/projects/"), "/messages:send")
+		_ = json.NewEncoder(w).Encode(map[string]string{"name": "projects/" + project + "/messages/0"})
+		return
+	}
+	writeFCMError(w, reply, reply.Reason)
+}
+
+func writeFCMError(w http.ResponseWriter, reply Reply, message string) {
+	status, ok := grpcStatuses[reply.Status]
+	if !ok {
+		status = "UNKNOWN"
+	}
+	errorBody := map[string]any{
+		"code":    reply.Status,
+		"message": message,
+		"status":  status,
+	}
+	if reply.Reason != "" {
+		errorBody["details"] = []map[string]string{{
+			"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			"errorCode": reply.Reason,
+		}}
+	}
+
+	w.WriteHeader(reply.Status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": errorBody})
+}
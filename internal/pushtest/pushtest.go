@@ -0,0 +1,156 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+// Package pushtest provides in-process stand-ins of APNs and FCM to test the
+// push proxy end to end, without contacting Apple or Google.
+//
+// Both servers speak HTTP/2 over TLS with a self-signed certificate, record
+// every notification they receive, and reply with what the test scripted
+// for each device token:
+//
+//	apns := pushtest.NewAPNs()
+//	defer apns.Close()
+//	apns.ReplyTo("stale-token", pushtest.APNsUnregistered)
+//
+//	settings := server.ApplePushSettings{
+//		ApplePushEndpoint: apns.URL(),
+//		ApplePushCAFile:   apns.CAFile(),
+//		...
+//	}
+package pushtest
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Reply is what a fake server answers to a notification. The zero Reply is a
+// successful delivery.
+type Reply struct {
+	// Status is the HTTP status code of the reply, 200 when zero.
+	Status int
+	// Reason is the APNs reason, or the FCM error code, of a failure.
+	Reason string
+	// Delay holds the reply back, e.g. to make the sender time out.
+	Delay time.Duration
+}
+
+// Timeout returns a successful Reply that only comes after d.
+func Timeout(d time.Duration) Reply {
+	return Reply{Delay: d}
+}
+
+// Request is a notification received by a fake server.
+type Request struct {
+	DeviceToken string
+	Path        string
+	Header      http.Header
+	// Body is the JSON payload for APNs, and the JSON message for FCM.
+	Body []byte
+}
+
+// server holds what the fake APNs and FCM have in common.
+type server struct {
+	srv    *httptest.Server
+	dir    string
+	caFile string
+
+	mut          sync.Mutex
+	replies      map[string]Reply
+	defaultReply Reply
+	requests     []Request
+}
+
+func newServer(handler http.Handler) *server {
+	s := &server{replies: make(map[string]Reply)}
+
+	s.srv = httptest.NewUnstartedServer(handler)
+	s.srv.EnableHTTP2 = true
+	s.srv.StartTLS()
+
+	dir, err := os.MkdirTemp("", "pushtest-")
+	if err != nil {
+		panic("pushtest: failed to create temporary directory: " + err.Error())
+	}
+	s.dir = dir
+	s.caFile = filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(s.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.srv.Certificate().Raw}), 0600); err != nil {
+		panic("pushtest: failed to write CA file: " + err.Error())
+	}
+	return s
+}
+
+// URL returns the base URL of the server.
+func (s *server) URL() string {
+	return s.srv.URL
+}
+
+// CAFile returns the path of a PEM file holding the certificate the server
+// is served with.
+func (s *server) CAFile() string {
+	return s.caFile
+}
+
+// ReplyTo scripts the reply to the notifications sent to deviceToken.
+func (s *server) ReplyTo(deviceToken string, reply Reply) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.replies[deviceToken] = reply
+}
+
+// ReplyToAll scripts the reply to the notifications sent to device tokens
+// without a reply of their own.
+func (s *server) ReplyToAll(reply Reply) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.defaultReply = reply
+}
+
+// Requests returns the notifications received so far.
+func (s *server) Requests() []Request {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Reset forgets the notifications received and the scripted replies.
+func (s *server) Reset() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.replies = make(map[string]Reply)
+	s.defaultReply = Reply{}
+	s.requests = nil
+}
+
+// Close shuts the server down.
+func (s *server) Close() {
+	s.srv.Close()
+	os.RemoveAll(s.dir)
+}
+
+// record stores a received notification and returns the reply scripted for
+// it, once its delay has passed. It returns false when the request was
+// abandoned by the client in the meantime.
+func (s *server) record(r *http.Request, req Request) (Reply, bool) {
+	s.mut.Lock()
+	s.requests = append(s.requests, req)
+	reply, ok := s.replies[req.DeviceToken]
+	if !ok {
+		reply = s.defaultReply
+	}
+	s.mut.Unlock()
+
+	if reply.Delay > 0 {
+		select {
+		case <-time.After(reply.Delay):
+		case <-r.Context().Done():
+			return reply, false
+		}
+	}
+	return reply, true
+}
@@ -5,6 +5,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -12,16 +13,23 @@ import (
 
 	"github.com/mattermost/mattermost-push-proxy/internal/version"
 	"github.com/mattermost/mattermost-push-proxy/server"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
 )
 
 var (
-	flagConfigFile string
-	falgVersion    bool
+	flagConfigFile     string
+	falgVersion        bool
+	flagValidateConfig bool
+	flagEncryptSecrets string
+	flagGenerateVAPID  bool
 )
 
 func main() {
 	flag.StringVar(&flagConfigFile, "config", "mattermost-push-proxy.json", "")
 	flag.BoolVar(&falgVersion, "version", false, "")
+	flag.BoolVar(&flagValidateConfig, "validate-config", false, "check the config and exit")
+	flag.StringVar(&flagEncryptSecrets, "encrypt-secrets", "", "encrypt a JSON file of secrets for SecretsFile and print it")
+	flag.BoolVar(&flagGenerateVAPID, "generate-vapid-keys", false, "generate a VAPID key pair for WebPushSettings and print it")
 	flag.Parse()
 
 	if falgVersion {
@@ -32,7 +40,45 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flagEncryptSecrets != "" {
+		plain, err := os.ReadFile(flagEncryptSecrets)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sealed, err := server.EncryptSecrets(plain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(sealed)
+
+		os.Exit(0)
+	}
+
+	if flagGenerateVAPID {
+		privateKey, publicKey, err := server.GenerateVAPIDKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("VAPIDPrivateKey: %v\napplicationServerKey: %v\n", privateKey, publicKey)
+
+		os.Exit(0)
+	}
+
 	fileName := server.FindConfigFile(flagConfigFile)
+	if flagValidateConfig {
+		problems := server.ValidateConfig(fileName)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%v: %d problem(s) found\n", fileName, len(problems))
+			os.Exit(1)
+		}
+
+		fmt.Printf("%v: config is valid\n", fileName)
+		os.Exit(0)
+	}
+
 	cfg, err := server.LoadConfig(fileName)
 	if err != nil {
 		// We just do a hard exit, because the app won't be able to start without a config.
@@ -52,13 +98,23 @@ func main() {
 	logger.Info("Loading " + fileName)
 
 	srv := server.New(cfg, logger)
+	srv.SetConfigFile(fileName)
 	srv.Start()
 
-	// wait for kill signal before attempting to gracefully shutdown
-	// the running service
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-stopChan
+	// reload the config on SIGHUP, and wait for kill signal before
+	// attempting to gracefully shutdown the running service
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		logger.Info("Reloading " + fileName)
+		if err := srv.ReloadConfig(); err != nil {
+			logger.Error("Failed to reload config, keeping the current one", mlog.Err(err))
+		}
+	}
 
 	srv.Stop()
 }
@@ -0,0 +1,106 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACCESS_TOKEN_REFRESH_AHEAD is how long before they expire access tokens
+// are renewed, at most half of their lifetime.
+const ACCESS_TOKEN_REFRESH_AHEAD = 5 * time.Minute
+
+// errAccessToken wraps the rejections of client credentials, that retrying
+// cannot fix.
+var errAccessToken = errors.New("failed to get access token")
+
+// clientCredentialsToken caches the access token of an OAuth client
+// credentials grant, as used by Huawei Push Kit and WNS.
+type clientCredentialsToken struct {
+	client   *http.Client
+	tokenURL string
+	// form holds the client credentials and other parameters of the grant.
+	form url.Values
+
+	mut         sync.Mutex
+	accessToken string
+	refreshAt   time.Time
+}
+
+func newClientCredentialsToken(client *http.Client, tokenURL string, form url.Values) *clientCredentialsToken {
+	form.Set("grant_type", "client_credentials")
+	return &clientCredentialsToken{
+		client:   client,
+		tokenURL: tokenURL,
+		form:     form,
+	}
+}
+
+// get returns the current access token, requesting a new one when it is
+// about to expire. Credentials rejected with a 400 or 401 reply are reported
+// as errAccessToken, while other failures, e.g. transport errors or a server
+// error of the token endpoint, are returned as plain errors.
+func (t *clientCredentialsToken) get(ctx context.Context) (string, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.accessToken != "" && time.Now().Before(t.refreshAt) {
+		return t.accessToken, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.tokenURL, strings.NewReader(t.form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            any    `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	// Client errors other than 400 and 401, e.g. 429, may go away on their
+	// own.
+	rejected := resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		if rejected {
+			return "", fmt.Errorf("%w: status %v: %v", errAccessToken, resp.StatusCode, err)
+		}
+		return "", fmt.Errorf("failed to get access token: status %v: %v", resp.StatusCode, err)
+	}
+	if rejected {
+		return "", fmt.Errorf("%w: status %v: %v %v", errAccessToken, resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("failed to get access token: status %v: %v %v", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	t.accessToken = token.AccessToken
+	t.refreshAt = time.Now().Add(lifetime - min(ACCESS_TOKEN_REFRESH_AHEAD, lifetime/2))
+	return t.accessToken, nil
+}
+
+// reset drops the current access token, e.g. after it was revoked, so that
+// the next call to get requests a new one.
+func (t *clientCredentialsToken) reset() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.accessToken = ""
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientCredentialsToken(t *testing.T) {
+	var mut sync.Mutex
+	issued := 0
+	status := http.StatusOK
+	expiresIn := 3600
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		w.Header().Set("Content-Type", "application/json")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "error", "error_description": http.StatusText(status)})
+			return
+		}
+		issued++
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "expires_in": expiresIn})
+	}))
+	defer endpoint.Close()
+
+	reply := func(code, lifetime int) {
+		mut.Lock()
+		defer mut.Unlock()
+		status = code
+		expiresIn = lifetime
+		issued = 0
+	}
+
+	t.Run("tokens are reused until they are about to expire", func(t *testing.T) {
+		for _, lifetime := range []int{3600, 60} {
+			reply(http.StatusOK, lifetime)
+			token := newClientCredentialsToken(endpoint.Client(), endpoint.URL, url.Values{})
+			for range 3 {
+				accessToken, err := token.get(context.Background())
+				require.NoError(t, err)
+				assert.Equal(t, "token", accessToken)
+			}
+
+			mut.Lock()
+			assert.Equal(t, 1, issued, lifetime)
+			mut.Unlock()
+		}
+	})
+
+	t.Run("only rejected credentials are access token errors", func(t *testing.T) {
+		for code, rejected := range map[int]bool{
+			http.StatusBadRequest:          true,
+			http.StatusUnauthorized:        true,
+			http.StatusTooManyRequests:     false,
+			http.StatusInternalServerError: false,
+			http.StatusServiceUnavailable:  false,
+		} {
+			reply(code, 3600)
+			_, err := newClientCredentialsToken(endpoint.Client(), endpoint.URL, url.Values{}).get(context.Background())
+			require.Error(t, err)
+			assert.Equal(t, rejected, errors.Is(err, errAccessToken), code)
+		}
+	})
+}
@@ -5,17 +5,20 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
 	"github.com/kyokomi/emoji"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 
@@ -30,12 +33,16 @@ const (
 	invalidArgument     = "INVALID_ARGUMENT"
 	quotaExceeded       = "QUOTA_EXCEEDED"
 	unregistered        = "UNREGISTERED"
+	senderIDMismatch    = "SENDER_ID_MISMATCH"
 	unavailable         = "UNAVAILABLE"
 	tokenSourceError    = "TOKEN_SOURCE_ERROR"
 )
 
 const (
 	scope = "https://www.googleapis.com/auth/firebase.messaging"
+	// ANDROID_VOIP_COLLAPSE_KEY_PREFIX keeps call messages of a channel
+	// apart from its other messages.
+	ANDROID_VOIP_COLLAPSE_KEY_PREFIX = "voip_"
 )
 
 type AndroidNotificationServer struct {
@@ -79,7 +86,7 @@ func (me *AndroidNotificationServer) Initialize() error {
 		return errors.New("android push notifications not configured: missing ServiceFileLocation")
 	}
 
-	jsonKey, err := os.ReadFile(me.AndroidPushSettings.ServiceFileLocation)
+	jsonKey, err := readSecretFile(me.AndroidPushSettings.ServiceFileLocation, me.AndroidPushSettings.serviceFile)
 	if err != nil {
 		return fmt.Errorf("error reading service file: %v", err)
 	}
@@ -95,12 +102,34 @@ func (me *AndroidNotificationServer) Initialize() error {
 		return fmt.Errorf("error parsing service account JSON: %v", err)
 	}
 
-	opt := option.WithTokenSource(cfg.TokenSource(context.Background()))
+	opts := []option.ClientOption{option.WithTokenSource(cfg.TokenSource(context.Background()))}
+	if me.AndroidPushSettings.AndroidPushCAFile != "" {
+		rootCAs, err := loadCertPool(me.AndroidPushSettings.AndroidPushCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading AndroidPushCAFile: %v", err)
+		}
+
+		// Both access tokens and notifications are requested with a client
+		// trusting the custom CAs.
+		base := &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		}
+		tokenCtx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: base})
+		opts = []option.ClientOption{option.WithHTTPClient(&http.Client{
+			Transport: &oauth2.Transport{Source: cfg.TokenSource(tokenCtx), Base: base},
+		})}
+	}
+	if me.AndroidPushSettings.AndroidPushEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(me.AndroidPushSettings.AndroidPushEndpoint, "/")))
+		me.logger.Info("Sending android notifications to a custom endpoint", mlog.String("type", me.AndroidPushSettings.Type), mlog.String("endpoint", me.AndroidPushSettings.AndroidPushEndpoint))
+	}
+
 	conf := &firebase.Config{
 		ProjectID:        serviceAcc.ProjectID,
 		ServiceAccountID: serviceAcc.ClientEmail,
 	}
-	app, err := firebase.NewApp(context.Background(), conf, opt)
+	app, err := firebase.NewApp(context.Background(), conf, opts...)
 	if err != nil {
 		return fmt.Errorf("error initializing app: %v", err)
 	}
@@ -116,67 +145,32 @@ func (me *AndroidNotificationServer) Initialize() error {
 
 func (me *AndroidNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
 	pushType := msg.Type
-	data := map[string]string{
-		"ack_id":         msg.AckId,
-		"type":           pushType,
-		"sub_type":       string(msg.SubType),
-		"version":        msg.Version,
-		"channel_id":     msg.ChannelId,
-		"is_crt_enabled": strconv.FormatBool(msg.IsCRTEnabled),
-		"server_id":      msg.ServerId,
-		"category":       msg.Category,
-	}
-
-	if msg.Badge != -1 {
-		data["badge"] = strconv.Itoa(msg.Badge)
-	}
-
-	if msg.RootId != "" {
-		data["root_id"] = msg.RootId
-	}
-
-	if msg.Signature == "" {
-		data["signature"] = "NO_SIGNATURE"
-	} else {
-		data["signature"] = msg.Signature
-	}
-
-	if msg.IsIdLoaded {
-		data["post_id"] = msg.PostId
-		data["message"] = msg.Message
-		data["id_loaded"] = "true"
-		data["sender_id"] = msg.SenderId
-		data["sender_name"] = "Someone"
-		data["team_id"] = msg.TeamId
-	} else if pushType == model.PushTypeMessage || pushType == model.PushTypeSession {
-		data["team_id"] = msg.TeamId
-		data["sender_id"] = msg.SenderId
-		data["sender_name"] = msg.SenderName
-		data["message"] = emoji.Sprint(msg.Message)
-		data["channel_name"] = msg.ChannelName
-		data["post_id"] = msg.PostId
-		data["override_username"] = msg.OverrideUsername
-		data["override_icon_url"] = msg.OverrideIconURL
-		data["from_webhook"] = msg.FromWebhook
+	var transport model.PushTransport
+	var fcmMsg *messaging.Message
+	switch {
+	case msg.Type == PUSH_TYPE_CALL_DISMISS:
+		transport = model.PushTransportVoIP
+		fcmMsg = me.buildCallDismissMessage(msg)
+	case msg.Transport == model.PushTransportVoIP:
+		transport = model.PushTransportVoIP
+		fcmMsg = me.buildVoIPMessage(msg)
+	default:
+		transport = model.PushTransportStandard
+		fcmMsg = me.buildMessage(msg)
 	}
-
 	if me.metrics != nil {
-		me.metrics.incrementNotificationTotal(model.PushNotifyAndroid, pushType, model.PushTransportStandard)
-	}
-	fcmMsg := &messaging.Message{
-		Token: msg.DeviceId,
-		Data:  data,
-		Android: &messaging.AndroidConfig{
-			Priority: "high",
-		},
+		me.metrics.incrementNotificationTotal(model.PushNotifyAndroid, pushType, transport)
 	}
 
-	me.logger.Info(
-		"Sending android push notification",
+	logFields := []mlog.Field{
 		mlog.String("device", me.AndroidPushSettings.Type),
 		mlog.String("type", msg.Type),
 		mlog.String("ack_id", msg.AckId),
-	)
+	}
+	if transport != model.PushTransportStandard {
+		logFields = append(logFields, mlog.String("transport", string(transport)))
+	}
+	me.logger.Info("Sending android push notification", logFields...)
 	err := me.SendNotificationWithRetry(fcmMsg)
 	if err != nil {
 		errorCode, hasStatusCode := getErrorCode(err)
@@ -196,44 +190,210 @@ func (me *AndroidNotificationServer) SendNotification(_ int, msg *model.PushNoti
 		if messaging.IsUnregistered(err) || messaging.IsSenderIDMismatch(err) {
 			me.logger.Info("Android response failure sending remove code", mlog.String("type", me.AndroidPushSettings.Type))
 			if me.metrics != nil {
-				me.metrics.incrementRemoval(model.PushNotifyAndroid, pushType, model.PushTransportStandard, unregistered)
+				me.metrics.incrementRemoval(model.PushNotifyAndroid, pushType, transport, unregistered)
+			}
+			if messaging.IsSenderIDMismatch(err) {
+				return NewRemovePushResponseWithReason(upstreamReason("FCM", senderIDMismatch))
 			}
-			return NewRemovePushResponse()
+			return NewRemovePushResponseWithReason(upstreamReason("FCM", unregistered))
 		}
 
 		var reason string
+		var responseReason string
+		retryable := false
 		switch {
 		case messaging.IsInternal(err):
 			reason = internalError
+			retryable = true
 		case messaging.IsInvalidArgument(err):
 			reason = invalidArgument
 		case messaging.IsQuotaExceeded(err):
 			reason = quotaExceeded
+			retryable = true
 		case messaging.IsThirdPartyAuthError(err):
 			reason = thirdPartyAuthError
 		case messaging.IsUnavailable(err):
 			reason = unavailable
+			retryable = true
+		case errors.As(err, new(*oauth2.RetrieveError)):
+			// The service account was rejected when getting an access token.
+			reason = tokenSourceError
 		default:
 			reason = "unknown transport error"
-
+			if hasStatusCode {
+				responseReason = upstreamReason("FCM", errorCode)
+			} else {
+				responseReason = transportErrorReason(err)
+				retryable = true
+			}
+		}
+		if responseReason == "" {
+			responseReason = upstreamReason("FCM", reason)
 		}
 		if me.metrics != nil {
-			me.metrics.incrementFailure(model.PushNotifyAndroid, pushType, model.PushTransportStandard, reason)
+			me.metrics.incrementFailure(model.PushNotifyAndroid, pushType, transport, reason)
 		}
 
-		return NewErrorPushResponse(err.Error())
+		return NewErrorPushResponseWithReason(err.Error(), responseReason, retryable)
 	}
 
 	if me.metrics != nil {
 		if msg.AckId != "" {
-			me.metrics.incrementSuccessWithAck(model.PushNotifyAndroid, pushType, model.PushTransportStandard)
+			me.metrics.incrementSuccessWithAck(model.PushNotifyAndroid, pushType, transport)
 		} else {
-			me.metrics.incrementSuccess(model.PushNotifyAndroid, pushType, model.PushTransportStandard)
+			me.metrics.incrementSuccess(model.PushNotifyAndroid, pushType, transport)
 		}
 	}
 	return NewOkPushResponse()
 }
 
+// buildMessage renders msg as the message sent to FCM.
+func (me *AndroidNotificationServer) buildMessage(msg *model.PushNotification) *messaging.Message {
+	priority := "high"
+	if isSilentPush(me.AndroidPushSettings.AndroidSilentPushTypes, msg) {
+		priority = "normal"
+	}
+	return &messaging.Message{
+		Token: msg.DeviceId,
+		Data:  notificationData(msg),
+		Android: &messaging.AndroidConfig{
+			Priority: priority,
+		},
+	}
+}
+
+// buildVoIPMessage renders msg as the message ringing the call UI of the
+// Android app: a high priority data message with the same routing fields as
+// Apple VoIP pushes, which is dropped rather than delivered late.
+func (me *AndroidNotificationServer) buildVoIPMessage(msg *model.PushNotification) *messaging.Message {
+	data := map[string]string{
+		"transport":  string(model.PushTransportVoIP),
+		"type":       msg.Type,
+		"sub_type":   string(msg.SubType),
+		"channel_id": msg.ChannelId,
+		"server_id":  msg.ServerId,
+		"post_id":    msg.PostId,
+		"thread_id":  msg.RootId,
+		"sender_id":  msg.SenderId,
+		"id_loaded":  strconv.FormatBool(msg.IsIdLoaded),
+	}
+
+	// As on Apple, sender_name and channel_name are omitted for
+	// IdLoadedNotification and fetched by the device.
+	if msg.SenderName != "" {
+		data["sender_name"] = msg.SenderName
+	}
+	if msg.ChannelName != "" {
+		data["channel_name"] = msg.ChannelName
+	}
+
+	if msg.AckId != "" {
+		data["ack_id"] = msg.AckId
+	}
+
+	if msg.Signature == "" {
+		data["signature"] = "NO_SIGNATURE"
+	} else {
+		data["signature"] = msg.Signature
+	}
+
+	ttl := time.Duration(0)
+	return &messaging.Message{
+		Token: msg.DeviceId,
+		Data:  data,
+		Android: &messaging.AndroidConfig{
+			Priority:    "high",
+			TTL:         &ttl,
+			CollapseKey: ANDROID_VOIP_COLLAPSE_KEY_PREFIX + msg.ChannelId,
+		},
+	}
+}
+
+// buildCallDismissMessage renders msg as the data message stopping the call
+// UI. It shares the collapse key of the call messages of the channel, so that
+// it replaces one that was not delivered yet.
+func (me *AndroidNotificationServer) buildCallDismissMessage(msg *model.PushNotification) *messaging.Message {
+	data := map[string]string{
+		"type":       msg.Type,
+		"sub_type":   string(msg.SubType),
+		"channel_id": msg.ChannelId,
+		"server_id":  msg.ServerId,
+		"post_id":    msg.PostId,
+	}
+
+	if msg.AckId != "" {
+		data["ack_id"] = msg.AckId
+	}
+
+	if msg.Signature == "" {
+		data["signature"] = "NO_SIGNATURE"
+	} else {
+		data["signature"] = msg.Signature
+	}
+
+	ttl := time.Duration(0)
+	return &messaging.Message{
+		Token: msg.DeviceId,
+		Data:  data,
+		Android: &messaging.AndroidConfig{
+			Priority:    "high",
+			TTL:         &ttl,
+			CollapseKey: ANDROID_VOIP_COLLAPSE_KEY_PREFIX + msg.ChannelId,
+		},
+	}
+}
+
+// notificationData renders msg as the flat data map the Android app reads.
+// Other targets delivering data messages send the same map.
+func notificationData(msg *model.PushNotification) map[string]string {
+	pushType := msg.Type
+	data := map[string]string{
+		"ack_id":         msg.AckId,
+		"type":           pushType,
+		"sub_type":       string(msg.SubType),
+		"version":        msg.Version,
+		"channel_id":     msg.ChannelId,
+		"is_crt_enabled": strconv.FormatBool(msg.IsCRTEnabled),
+		"server_id":      msg.ServerId,
+		"category":       msg.Category,
+	}
+
+	if msg.Badge != -1 {
+		data["badge"] = strconv.Itoa(msg.Badge)
+	}
+
+	if msg.RootId != "" {
+		data["root_id"] = msg.RootId
+	}
+
+	if msg.Signature == "" {
+		data["signature"] = "NO_SIGNATURE"
+	} else {
+		data["signature"] = msg.Signature
+	}
+
+	if msg.IsIdLoaded {
+		data["post_id"] = msg.PostId
+		data["message"] = msg.Message
+		data["id_loaded"] = "true"
+		data["sender_id"] = msg.SenderId
+		data["sender_name"] = "Someone"
+		data["team_id"] = msg.TeamId
+	} else if pushType == model.PushTypeMessage || pushType == model.PushTypeSession {
+		data["team_id"] = msg.TeamId
+		data["sender_id"] = msg.SenderId
+		data["sender_name"] = msg.SenderName
+		data["message"] = emoji.Sprint(msg.Message)
+		data["channel_name"] = msg.ChannelName
+		data["post_id"] = msg.PostId
+		data["override_username"] = msg.OverrideUsername
+		data["override_icon_url"] = msg.OverrideIconURL
+		data["from_webhook"] = msg.FromWebhook
+	}
+
+	return data
+}
+
 func (me *AndroidNotificationServer) SendNotificationWithRetry(fcmMsg *messaging.Message) error {
 	var err error
 	waitTime := time.Second
@@ -10,8 +10,10 @@ import (
 	"os"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/shared/mlog"
 )
 
@@ -81,3 +83,84 @@ func TestGetErrorCode(t *testing.T) {
 	require.Equal(t, "", extractedCode)
 	require.False(t, found)
 }
+
+func TestBuildVoIPMessage(t *testing.T) {
+	srv := &AndroidNotificationServer{}
+	msg := &model.PushNotification{
+		DeviceId:    "tok",
+		Type:        model.PushTypeMessage,
+		SubType:     model.PushSubTypeCalls,
+		ChannelId:   "channel1",
+		ServerId:    "server1",
+		PostId:      "post1",
+		RootId:      "thread1",
+		SenderId:    "sender1",
+		SenderName:  "Sender Name",
+		ChannelName: "Channel Name",
+		Message:     "not sent",
+		AckId:       "ack1",
+	}
+	fcmMsg := srv.buildVoIPMessage(msg)
+
+	assert.Equal(t, "tok", fcmMsg.Token)
+	assert.Equal(t, "high", fcmMsg.Android.Priority)
+	require.NotNil(t, fcmMsg.Android.TTL)
+	assert.Zero(t, *fcmMsg.Android.TTL, "calls must ring now or never")
+	assert.Equal(t, "voip_channel1", fcmMsg.Android.CollapseKey)
+
+	// The same routing fields as Apple VoIP pushes.
+	assert.Equal(t, map[string]string{
+		"transport":    "voip",
+		"type":         model.PushTypeMessage,
+		"sub_type":     string(model.PushSubTypeCalls),
+		"channel_id":   "channel1",
+		"server_id":    "server1",
+		"post_id":      "post1",
+		"thread_id":    "thread1",
+		"sender_id":    "sender1",
+		"id_loaded":    "false",
+		"sender_name":  "Sender Name",
+		"channel_name": "Channel Name",
+		"ack_id":       "ack1",
+		"signature":    "NO_SIGNATURE",
+	}, fcmMsg.Data)
+}
+
+func TestBuildCallDismissMessage(t *testing.T) {
+	srv := &AndroidNotificationServer{}
+	fcmMsg := srv.buildCallDismissMessage(&model.PushNotification{
+		DeviceId:  "tok",
+		Type:      PUSH_TYPE_CALL_DISMISS,
+		SubType:   model.PushSubTypeCalls,
+		ChannelId: "channel1",
+		ServerId:  "server1",
+		PostId:    "post1",
+		Signature: "signed",
+	})
+
+	assert.Equal(t, "tok", fcmMsg.Token)
+	assert.Equal(t, "high", fcmMsg.Android.Priority)
+	require.NotNil(t, fcmMsg.Android.TTL)
+	assert.Zero(t, *fcmMsg.Android.TTL)
+	assert.Equal(t, srv.buildVoIPMessage(&model.PushNotification{ChannelId: "channel1"}).Android.CollapseKey, fcmMsg.Android.CollapseKey, "dismissals must replace pending call messages")
+	assert.Equal(t, map[string]string{
+		"type":       PUSH_TYPE_CALL_DISMISS,
+		"sub_type":   string(model.PushSubTypeCalls),
+		"channel_id": "channel1",
+		"server_id":  "server1",
+		"post_id":    "post1",
+		"signature":  "signed",
+	}, fcmMsg.Data)
+}
+
+func TestBuildMessagePriority(t *testing.T) {
+	srv := &AndroidNotificationServer{}
+	assert.Equal(t, "high", srv.buildMessage(&model.PushNotification{Type: model.PushTypeMessage}).Android.Priority)
+	assert.Equal(t, "high", srv.buildMessage(&model.PushNotification{Type: model.PushTypeClear, IsIdLoaded: true}).Android.Priority)
+	assert.Equal(t, "normal", srv.buildMessage(&model.PushNotification{Type: model.PushTypeClear}).Android.Priority)
+	assert.Equal(t, "normal", srv.buildMessage(&model.PushNotification{Type: model.PushTypeUpdateBadge}).Android.Priority)
+
+	srv.AndroidPushSettings.AndroidSilentPushTypes = []string{model.PushTypeUpdateBadge, model.PushTypeTest}
+	assert.Equal(t, "high", srv.buildMessage(&model.PushNotification{Type: model.PushTypeClear}).Android.Priority)
+	assert.Equal(t, "normal", srv.buildMessage(&model.PushNotification{Type: model.PushTypeTest}).Android.Priority)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	apns "github.com/sideshow/apns2"
+)
+
+// PUSH_TRANSPORT_LIVE_ACTIVITY sends a notification as an update of a Live
+// Activity on iOS. The message of such notifications is a JSON encoded
+// liveActivityUpdate.
+const PUSH_TRANSPORT_LIVE_ACTIVITY model.PushTransport = "liveactivity"
+
+// PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST sends the update of a Live Activity
+// to every activity subscribed to a broadcast channel, whose id is given as
+// the device id of the notification.
+const PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST model.PushTransport = "liveactivitybroadcast"
+
+// isLiveActivityTransport reports whether notifications sent with transport
+// carry a liveActivityUpdate.
+func isLiveActivityTransport(transport model.PushTransport) bool {
+	return transport == PUSH_TRANSPORT_LIVE_ACTIVITY || transport == PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST
+}
+
+// Live Activity events.
+const (
+	LIVE_ACTIVITY_EVENT_START  = "start"
+	LIVE_ACTIVITY_EVENT_UPDATE = "update"
+	LIVE_ACTIVITY_EVENT_END    = "end"
+)
+
+// liveActivityUpdate starts, updates or ends a Live Activity. Dates are Unix
+// timestamps in seconds.
+type liveActivityUpdate struct {
+	Event        string         `json:"event"`
+	ContentState map[string]any `json:"content_state"`
+	// StaleDate is when the activity is shown as outdated, and
+	// DismissalDate when an ended activity is removed from the lock screen.
+	StaleDate     int64 `json:"stale_date,omitempty"`
+	DismissalDate int64 `json:"dismissal_date,omitempty"`
+	// Timestamp orders the updates of an activity, the time the update is
+	// sent when zero.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// AttributesType and Attributes describe the activity to start.
+	AttributesType string         `json:"attributes_type,omitempty"`
+	Attributes     map[string]any `json:"attributes,omitempty"`
+	// Alert is shown when the activity starts, and optionally when it is
+	// updated or ends.
+	Alert *liveActivityAlert `json:"alert,omitempty"`
+}
+
+type liveActivityAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+}
+
+// parseLiveActivityUpdate decodes and checks the message of a live activity
+// notification.
+func parseLiveActivityUpdate(message string) (*liveActivityUpdate, error) {
+	var update liveActivityUpdate
+	if err := json.Unmarshal([]byte(message), &update); err != nil {
+		return nil, fmt.Errorf("invalid live activity update: %w", err)
+	}
+
+	switch update.Event {
+	case LIVE_ACTIVITY_EVENT_START:
+		if update.AttributesType == "" || update.Attributes == nil {
+			return nil, errors.New("invalid live activity update: attributes_type and attributes are required to start an activity")
+		}
+		if update.Alert == nil {
+			return nil, errors.New("invalid live activity update: alert is required to start an activity")
+		}
+	case LIVE_ACTIVITY_EVENT_UPDATE, LIVE_ACTIVITY_EVENT_END:
+	default:
+		return nil, fmt.Errorf("invalid live activity update: unknown event %q", update.Event)
+	}
+	if update.ContentState == nil {
+		return nil, errors.New("invalid live activity update: content_state is required")
+	}
+	return &update, nil
+}
+
+// buildLiveActivityNotification renders msg as a liveactivity push to the
+// activity token in its device id, or to the push-to-start token of the app
+// for start events. Broadcast notifications go to the channel in the device
+// id instead.
+func (me *AppleNotificationServer) buildLiveActivityNotification(msg *model.PushNotification) (*apns.Notification, error) {
+	update, err := parseLiveActivityUpdate(msg.Message)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Transport == PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST && update.Event == LIVE_ACTIVITY_EVENT_START {
+		return nil, errors.New("invalid live activity update: activities cannot be started on a broadcast channel")
+	}
+
+	timestamp := update.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	aps := map[string]any{
+		"event":         update.Event,
+		"timestamp":     timestamp,
+		"content-state": update.ContentState,
+	}
+	if update.StaleDate != 0 {
+		aps["stale-date"] = update.StaleDate
+	}
+	if update.DismissalDate != 0 {
+		aps["dismissal-date"] = update.DismissalDate
+	}
+	if update.Event == LIVE_ACTIVITY_EVENT_START {
+		aps["attributes-type"] = update.AttributesType
+		aps["attributes"] = update.Attributes
+	}
+
+	// Updates without an alert are not shown to the user, APNs delivers them
+	// at its discretion to save power.
+	priority := apns.PriorityLow
+	if update.Alert != nil {
+		aps["alert"] = map[string]string{"title": update.Alert.Title, "body": update.Alert.Body}
+		priority = apns.PriorityHigh
+	}
+
+	data := map[string]any{
+		"aps":        aps,
+		"type":       msg.Type,
+		"sub_type":   msg.SubType,
+		"server_id":  msg.ServerId,
+		"channel_id": msg.ChannelId,
+		"post_id":    msg.PostId,
+	}
+	if msg.AckId != "" {
+		data["ack_id"] = msg.AckId
+	}
+	if msg.Signature == "" {
+		data["signature"] = "NO_SIGNATURE"
+	} else {
+		data["signature"] = msg.Signature
+	}
+
+	return &apns.Notification{
+		DeviceToken: msg.DeviceId,
+		Payload:     data,
+		Topic:       me.ApplePushSettings.ApplePushTopic + ".push-type.liveactivity",
+		Priority:    priority,
+		PushType:    apns.PushTypeLiveActivity,
+	}, nil
+}
+
+// broadcastWithContext sends n to the broadcast channel in its device token,
+// the way AppleClient.PushWithContext sends notifications to a device.
+func (me *AppleNotificationServer) broadcastWithContext(ctx apns.Context, n *apns.Notification) (*apns.Response, error) {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	url := me.AppleClient.Host + "/4/broadcasts/apps/" + me.ApplePushSettings.ApplePushTopic
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	if me.AppleClient.Token != nil {
+		request.Header.Set("authorization", "bearer "+me.AppleClient.Token.GenerateIfExpired())
+	}
+	request.Header.Set("Content-Type", "application/json; charset=utf-8")
+	request.Header.Set("apns-channel-id", n.DeviceToken)
+	request.Header.Set("apns-push-type", string(n.PushType))
+	request.Header.Set("apns-priority", strconv.Itoa(n.Priority))
+
+	response, err := me.AppleClient.HTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	r := &apns.Response{
+		StatusCode: response.StatusCode,
+		ApnsID:     response.Header.Get("apns-request-id"),
+	}
+	if err := json.NewDecoder(response.Body).Decode(r); err != nil && err != io.EOF {
+		return &apns.Response{}, err
+	}
+	return r, nil
+}
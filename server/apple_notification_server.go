@@ -5,10 +5,13 @@ package server
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/kyokomi/emoji"
@@ -29,6 +32,7 @@ type AppleNotificationServer struct {
 	ApplePushSettings ApplePushSettings
 	sendTimeout       time.Duration
 	retryTimeout      time.Duration
+	certExpiry        time.Time
 }
 
 func NewAppleNotificationServer(settings ApplePushSettings, logger *mlog.Logger, metrics *metrics, sendTimeoutSecs int, retryTimeoutSecs int) *AppleNotificationServer {
@@ -75,9 +79,63 @@ func (me *AppleNotificationServer) setupProxySettings(appleCert *tls.Certificate
 	return nil
 }
 
+// setupEndpoint points the client to ApplePushEndpoint, trusting the CAs of
+// ApplePushCAFile, when they are set.
+func (me *AppleNotificationServer) setupEndpoint() error {
+	if me.ApplePushSettings.ApplePushEndpoint != "" {
+		me.AppleClient.Host = strings.TrimSuffix(me.ApplePushSettings.ApplePushEndpoint, "/")
+		me.logger.Info("Sending apple notifications to a custom endpoint", mlog.String("type", me.ApplePushSettings.Type), mlog.String("endpoint", me.AppleClient.Host))
+	}
+
+	if me.ApplePushSettings.ApplePushCAFile == "" {
+		return nil
+	}
+	rootCAs, err := loadCertPool(me.ApplePushSettings.ApplePushCAFile)
+	if err != nil {
+		return fmt.Errorf("failed to load ApplePushCAFile for type=%v: %v", me.ApplePushSettings.Type, err)
+	}
+
+	switch transport := me.AppleClient.HTTPClient.Transport.(type) {
+	case *http2.Transport:
+		transport.TLSClientConfig = withRootCAs(transport.TLSClientConfig, rootCAs)
+	case *http.Transport:
+		transport.TLSClientConfig = withRootCAs(transport.TLSClientConfig, rootCAs)
+	}
+	return nil
+}
+
+// withRootCAs returns a copy of cfg trusting rootCAs.
+func withRootCAs(cfg *tls.Config, rootCAs *x509.CertPool) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.RootCAs = rootCAs
+	return cfg
+}
+
+// loadAuthKey loads the token signing key of AppleAuthKeyFile.
+func (settings ApplePushSettings) loadAuthKey() (*ecdsa.PrivateKey, error) {
+	buf, err := readSecretFile(settings.AppleAuthKeyFile, settings.authKey)
+	if err != nil {
+		return nil, err
+	}
+	return token.AuthKeyFromBytes(buf)
+}
+
+// loadPushCert loads the client certificate of ApplePushCertPrivate.
+func (settings ApplePushSettings) loadPushCert() (tls.Certificate, error) {
+	buf, err := readSecretFile(settings.ApplePushCertPrivate, settings.pushCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return certificate.FromPemBytes(buf, settings.ApplePushCertPassword)
+}
+
 func (me *AppleNotificationServer) Initialize() error {
 	if me.ApplePushSettings.AppleAuthKeyFile != "" && me.ApplePushSettings.AppleAuthKeyID != "" && me.ApplePushSettings.AppleTeamID != "" {
-		authKey, err := token.AuthKeyFromFile(me.ApplePushSettings.AppleAuthKeyFile)
+		authKey, err := me.ApplePushSettings.loadAuthKey()
 		if err != nil {
 			return fmt.Errorf("failed to initialize apple notification service with AuthKey file err=%v ", err)
 		}
@@ -95,15 +153,25 @@ func (me *AppleNotificationServer) Initialize() error {
 		}
 
 		// Override the native transport.
-		return me.setupProxySettings(nil)
+		if err := me.setupProxySettings(nil); err != nil {
+			return err
+		}
+		return me.setupEndpoint()
 	}
 
 	if me.ApplePushSettings.ApplePushCertPrivate != "" {
-		appleCert, appleCertErr := certificate.FromPemFile(me.ApplePushSettings.ApplePushCertPrivate, me.ApplePushSettings.ApplePushCertPassword)
+		appleCert, appleCertErr := me.ApplePushSettings.loadPushCert()
 		if appleCertErr != nil {
 			return fmt.Errorf("failed to initialize apple notification service with pem cert err=%v for type=%v", appleCertErr, me.ApplePushSettings.Type)
 		}
 
+		if appleCert.Leaf != nil {
+			if err := checkAppleCertificateTopic(appleCert.Leaf, me.ApplePushSettings.ApplePushTopic); err != nil {
+				return fmt.Errorf("failed to initialize apple notification service with pem cert err=%v for type=%v", err, me.ApplePushSettings.Type)
+			}
+			me.certExpiry = appleCert.Leaf.NotAfter
+		}
+
 		if me.ApplePushSettings.ApplePushUseDevelopment {
 			me.AppleClient = apns.NewClient(appleCert).Development()
 		} else {
@@ -111,17 +179,42 @@ func (me *AppleNotificationServer) Initialize() error {
 		}
 
 		// Override the native transport.
-		return me.setupProxySettings(&appleCert)
+		if err := me.setupProxySettings(&appleCert); err != nil {
+			return err
+		}
+		return me.setupEndpoint()
 	}
 
 	return fmt.Errorf("apple push notifications not configured: missing ApplePushCertPrivate for type=%v", me.ApplePushSettings.Type)
 }
 
+// credentialsExpiry returns when the PEM certificate expires. Auth keys
+// don't expire.
+func (me *AppleNotificationServer) credentialsExpiry() time.Time {
+	return me.certExpiry
+}
+
 func (me *AppleNotificationServer) SendNotification(appVersion int, msg *model.PushNotification) PushResponse {
-	if msg.Transport == model.PushTransportVoIP {
+	if msg.Type == PUSH_TYPE_CALL_DISMISS {
+		return me.sendCallDismissNotification(msg)
+	}
+	switch msg.Transport {
+	case model.PushTransportVoIP:
 		return me.sendVoIPNotification(msg)
+	case PUSH_TRANSPORT_LIVE_ACTIVITY, PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST:
+		return me.sendLiveActivityNotification(msg)
 	}
 
+	notification := me.buildNotification(appVersion, msg)
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(model.PushNotifyApple, msg.Type, model.PushTransportStandard)
+	}
+
+	return me.dispatchAndHandleResponse(notification, msg, msg.Type, model.PushTransportStandard)
+}
+
+// buildNotification renders msg as the standard notification sent to APNs.
+func (me *AppleNotificationServer) buildNotification(appVersion int, msg *model.PushNotification) *apns.Notification {
 	data := payload.NewPayload()
 	if msg.Badge == 0 && msg.Type == model.PushTypeClear && appVersion > 1 {
 		data.Badge(1)
@@ -172,8 +265,11 @@ func (me *AppleNotificationServer) SendNotification(appVersion int, msg *model.P
 			// Handled by the apps, nothing else to do here
 		}
 	}
-	if me.metrics != nil {
-		me.metrics.incrementNotificationTotal(model.PushNotifyApple, pushType, model.PushTransportStandard)
+	if isSilentPush(me.ApplePushSettings.AppleSilentPushTypes, msg) {
+		// Background pushes must carry content-available.
+		data.ContentAvailable()
+		notification.PushType = apns.PushTypeBackground
+		notification.Priority = apns.PriorityLow
 	}
 	data.Custom("type", pushType)
 	data.Custom("sub_type", msg.SubType)
@@ -233,7 +329,7 @@ func (me *AppleNotificationServer) SendNotification(appVersion int, msg *model.P
 		data.Custom("from_webhook", msg.FromWebhook)
 	}
 
-	return me.dispatchAndHandleResponse(notification, msg, pushType, model.PushTransportStandard)
+	return notification
 }
 
 func (me *AppleNotificationServer) dispatchAndHandleResponse(notification *apns.Notification, msg *model.PushNotification, pushType string, transport model.PushTransport) PushResponse {
@@ -251,7 +347,11 @@ func (me *AppleNotificationServer) dispatchAndHandleResponse(notification *apns.
 	}
 	me.logger.Info("Sending apple push notification", logFields...)
 
-	res, err := me.SendNotificationWithRetry(notification)
+	push := me.AppleClient.PushWithContext
+	if transport == PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST {
+		push = me.broadcastWithContext
+	}
+	res, err := me.sendWithRetry(notification, push)
 	if err != nil {
 		errFields := []mlog.Field{
 			mlog.String("sid", msg.ServerId),
@@ -266,7 +366,7 @@ func (me *AppleNotificationServer) dispatchAndHandleResponse(notification *apns.
 		if me.metrics != nil {
 			me.metrics.incrementFailure(model.PushNotifyApple, pushType, transport, "RequestError")
 		}
-		return NewErrorPushResponse("unknown transport error")
+		return NewErrorPushResponseWithReason("unknown transport error", transportErrorReason(err), true)
 	}
 
 	if !res.Sent() {
@@ -281,7 +381,7 @@ func (me *AppleNotificationServer) dispatchAndHandleResponse(notification *apns.
 			if me.metrics != nil {
 				me.metrics.incrementRemoval(model.PushNotifyApple, pushType, transport, res.Reason)
 			}
-			return NewRemovePushResponse()
+			return NewRemovePushResponseWithReason(upstreamReason("APNS", res.Reason))
 		}
 
 		me.logger.Error(
@@ -294,7 +394,7 @@ func (me *AppleNotificationServer) dispatchAndHandleResponse(notification *apns.
 		if me.metrics != nil {
 			me.metrics.incrementFailure(model.PushNotifyApple, pushType, transport, res.Reason)
 		}
-		return NewErrorPushResponse("unknown send response error")
+		return NewErrorPushResponseWithReason("unknown send response error", upstreamReason("APNS", res.Reason), isRetryableAPNsReason(res.Reason))
 	}
 
 	if me.metrics != nil {
@@ -323,6 +423,25 @@ func (me *AppleNotificationServer) sendVoIPNotification(msg *model.PushNotificat
 	return me.dispatchAndHandleResponse(notification, msg, msg.Type, model.PushTransportVoIP)
 }
 
+// sendLiveActivityNotification dispatches an update of a Live Activity, or
+// of the activities of a broadcast channel.
+func (me *AppleNotificationServer) sendLiveActivityNotification(msg *model.PushNotification) PushResponse {
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(model.PushNotifyApple, msg.Type, msg.Transport)
+	}
+
+	notification, err := me.buildLiveActivityNotification(msg)
+	if err != nil {
+		me.logger.Error("Failed to build live activity notification", mlog.String("sid", msg.ServerId), mlog.String("type", me.ApplePushSettings.Type), mlog.Err(err))
+		if me.metrics != nil {
+			me.metrics.incrementFailure(model.PushNotifyApple, msg.Type, msg.Transport, REASON_BAD_REQUEST)
+		}
+		return NewErrorPushResponseWithReason(err.Error(), REASON_BAD_REQUEST, false)
+	}
+
+	return me.dispatchAndHandleResponse(notification, msg, msg.Type, msg.Transport)
+}
+
 func (me *AppleNotificationServer) buildVoIPNotification(msg *model.PushNotification) *apns.Notification {
 	data := payload.NewPayload().
 		ContentAvailable().
@@ -365,7 +484,72 @@ func (me *AppleNotificationServer) buildVoIPNotification(msg *model.PushNotifica
 	}
 }
 
+// sendCallDismissNotification dispatches a background push telling the app
+// to stop ringing. It is counted with VoIP pushes, since it belongs to the
+// call they started.
+func (me *AppleNotificationServer) sendCallDismissNotification(msg *model.PushNotification) PushResponse {
+	notification := me.buildCallDismissNotification(msg)
+
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(model.PushNotifyApple, msg.Type, model.PushTransportVoIP)
+	}
+
+	return me.dispatchAndHandleResponse(notification, msg, msg.Type, model.PushTransportVoIP)
+}
+
+// buildCallDismissNotification renders msg as a background push on the
+// standard topic. A VoIP push cannot be used, as iOS requires every VoIP
+// push to report a new call.
+func (me *AppleNotificationServer) buildCallDismissNotification(msg *model.PushNotification) *apns.Notification {
+	data := payload.NewPayload().
+		ContentAvailable().
+		Custom("type", msg.Type).
+		Custom("sub_type", msg.SubType).
+		Custom("channel_id", msg.ChannelId).
+		Custom("server_id", msg.ServerId).
+		Custom("post_id", msg.PostId)
+
+	if msg.AckId != "" {
+		data.Custom("ack_id", msg.AckId)
+	}
+
+	if msg.Signature == "" {
+		data.Custom("signature", "NO_SIGNATURE")
+	} else {
+		data.Custom("signature", msg.Signature)
+	}
+
+	// APNs only accepts background pushes with priority 5.
+	return &apns.Notification{
+		DeviceToken: msg.DeviceId,
+		Payload:     data,
+		Topic:       me.ApplePushSettings.ApplePushTopic,
+		Priority:    apns.PriorityLow,
+		PushType:    apns.PushTypeBackground,
+	}
+}
+
+// isRetryableAPNsReason reports whether APNs rejected a notification for a
+// reason that is not related to its content, so that sending it again later
+// may succeed.
+func isRetryableAPNsReason(reason string) bool {
+	switch reason {
+	case apns.ReasonTooManyRequests,
+		apns.ReasonInternalServerError,
+		apns.ReasonServiceUnavailable,
+		apns.ReasonShutdown,
+		apns.ReasonIdleTimeout:
+		return true
+	}
+	return false
+}
+
 func (me *AppleNotificationServer) SendNotificationWithRetry(notification *apns.Notification) (*apns.Response, error) {
+	return me.sendWithRetry(notification, me.AppleClient.PushWithContext)
+}
+
+// sendWithRetry sends notification with push, retrying transport errors.
+func (me *AppleNotificationServer) sendWithRetry(notification *apns.Notification, push func(apns.Context, *apns.Notification) (*apns.Response, error)) (*apns.Response, error) {
 	var res *apns.Response
 	var err error
 	waitTime := time.Second
@@ -380,7 +564,7 @@ func (me *AppleNotificationServer) SendNotificationWithRetry(notification *apns.
 
 		retryContext, cancelRetryContext := context.WithTimeout(generalContext, me.retryTimeout)
 		defer cancelRetryContext()
-		res, err = me.AppleClient.PushWithContext(retryContext, notification)
+		res, err = push(retryContext, notification)
 		if me.metrics != nil {
 			me.metrics.observerNotificationResponse(model.PushNotifyApple, time.Since(start).Seconds())
 		}
@@ -171,3 +171,180 @@ func marshalPayload(t *testing.T, n *apns.Notification) map[string]any {
 	require.NoError(t, json.Unmarshal(raw, &body))
 	return body
 }
+
+func TestBuildLiveActivityNotification(t *testing.T) {
+	srv := &AppleNotificationServer{
+		ApplePushSettings: ApplePushSettings{
+			ApplePushTopic: "com.mattermost.rnbeta",
+		},
+	}
+
+	t.Run("updates are sent to the liveactivity topic", func(t *testing.T) {
+		msg := &model.PushNotification{
+			DeviceId:  "activity-token",
+			Type:      model.PushTypeMessage,
+			SubType:   model.PushSubTypeCalls,
+			ChannelId: "channel1",
+			PostId:    "post1",
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY,
+			Message:   `{"event":"update","content_state":{"participants":3},"stale_date":1700000600,"timestamp":1700000000}`,
+		}
+		n, err := srv.buildLiveActivityNotification(msg)
+		require.NoError(t, err)
+
+		assert.Equal(t, "activity-token", n.DeviceToken)
+		assert.Equal(t, "com.mattermost.rnbeta.push-type.liveactivity", n.Topic)
+		assert.Equal(t, apns.PushTypeLiveActivity, n.PushType)
+		assert.Equal(t, apns.PriorityLow, n.Priority, "silent updates must not use the high priority budget")
+
+		body := marshalPayload(t, n)
+		assert.Equal(t, map[string]any{
+			"event":         "update",
+			"timestamp":     float64(1700000000),
+			"stale-date":    float64(1700000600),
+			"content-state": map[string]any{"participants": float64(3)},
+		}, body["aps"])
+		assert.Equal(t, "channel1", body["channel_id"])
+		assert.Equal(t, "post1", body["post_id"])
+		assert.Equal(t, "NO_SIGNATURE", body["signature"])
+	})
+
+	t.Run("start events carry the attributes and an alert", func(t *testing.T) {
+		msg := &model.PushNotification{
+			DeviceId:  "push-to-start-token",
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY,
+			Message:   `{"event":"start","content_state":{"status":"ringing"},"attributes_type":"CallAttributes","attributes":{"channel_id":"channel1"},"alert":{"title":"Town Square","body":"Incoming call"}}`,
+		}
+		n, err := srv.buildLiveActivityNotification(msg)
+		require.NoError(t, err)
+		assert.Equal(t, apns.PriorityHigh, n.Priority)
+
+		aps := marshalPayload(t, n)["aps"].(map[string]any)
+		assert.Equal(t, "start", aps["event"])
+		assert.NotZero(t, aps["timestamp"])
+		assert.Equal(t, "CallAttributes", aps["attributes-type"])
+		assert.Equal(t, map[string]any{"channel_id": "channel1"}, aps["attributes"])
+		assert.Equal(t, map[string]any{"title": "Town Square", "body": "Incoming call"}, aps["alert"])
+	})
+
+	t.Run("end events carry the dismissal date", func(t *testing.T) {
+		n, err := srv.buildLiveActivityNotification(&model.PushNotification{
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY,
+			Message:   `{"event":"end","content_state":{"status":"ended"},"dismissal_date":1700003600}`,
+		})
+		require.NoError(t, err)
+		aps := marshalPayload(t, n)["aps"].(map[string]any)
+		assert.Equal(t, float64(1700003600), aps["dismissal-date"])
+		assert.NotContains(t, aps, "attributes")
+	})
+
+	t.Run("broadcasts are sent to the channel", func(t *testing.T) {
+		n, err := srv.buildLiveActivityNotification(&model.PushNotification{
+			DeviceId:  "channel-id",
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST,
+			Message:   `{"event":"update","content_state":{"participants":3}}`,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "channel-id", n.DeviceToken)
+		assert.Equal(t, apns.PushTypeLiveActivity, n.PushType)
+	})
+
+	t.Run("rejects start events on broadcast channels", func(t *testing.T) {
+		_, err := srv.buildLiveActivityNotification(&model.PushNotification{
+			DeviceId:  "channel-id",
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST,
+			Message:   `{"event":"start","content_state":{},"attributes_type":"CallAttributes","attributes":{},"alert":{"body":"call"}}`,
+		})
+		assert.Error(t, err)
+	})
+
+	for name, message := range map[string]string{
+		"not json":              "hello",
+		"unknown event":         `{"event":"pause","content_state":{}}`,
+		"missing content state": `{"event":"update"}`,
+		"start without attrs":   `{"event":"start","content_state":{},"alert":{"body":"call"}}`,
+		"start without alert":   `{"event":"start","content_state":{},"attributes_type":"CallAttributes","attributes":{}}`,
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			_, err := srv.buildLiveActivityNotification(&model.PushNotification{Transport: PUSH_TRANSPORT_LIVE_ACTIVITY, Message: message})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSendCallDismissNotification(t *testing.T) {
+	m := newMetrics()
+	defer m.shutdown()
+
+	srv := &AppleNotificationServer{
+		ApplePushSettings: ApplePushSettings{
+			ApplePushTopic: "com.mattermost.rnbeta",
+		},
+		metrics: m,
+	}
+	msg := &model.PushNotification{
+		DeviceId:  "tok",
+		Type:      PUSH_TYPE_CALL_DISMISS,
+		SubType:   model.PushSubTypeCalls,
+		ChannelId: "channel1",
+		ServerId:  "server1",
+		PostId:    "post1",
+		Message:   "not sent",
+	}
+
+	t.Run("background push referencing the call", func(t *testing.T) {
+		n := srv.buildCallDismissNotification(msg)
+		assert.Equal(t, "tok", n.DeviceToken)
+		assert.Equal(t, "com.mattermost.rnbeta", n.Topic, "dismissals must not use the VoIP topic")
+		assert.Equal(t, apns.PushTypeBackground, n.PushType)
+		assert.Equal(t, apns.PriorityLow, n.Priority)
+
+		body := marshalPayload(t, n)
+		assert.Equal(t, map[string]any{"content-available": float64(1)}, body["aps"])
+		assert.Equal(t, PUSH_TYPE_CALL_DISMISS, body["type"])
+		assert.Equal(t, "channel1", body["channel_id"])
+		assert.Equal(t, "post1", body["post_id"])
+		assert.Equal(t, "server1", body["server_id"])
+	})
+
+	t.Run("counted with VoIP pushes", func(t *testing.T) {
+		require.Equal(t, NewOkPushResponse(), srv.SendNotification(1, msg))
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.metricNotificationsTotal.WithLabelValues(model.PushNotifyApple, PUSH_TYPE_CALL_DISMISS, string(model.PushTransportVoIP))))
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.metricNotificationsTotal.WithLabelValues(model.PushNotifyApple, PUSH_TYPE_CALL_DISMISS, string(model.PushTransportStandard))))
+	})
+}
+
+func TestBuildNotificationSilentPushes(t *testing.T) {
+	srv := &AppleNotificationServer{
+		ApplePushSettings: ApplePushSettings{
+			ApplePushTopic: "com.mattermost.rnbeta",
+		},
+	}
+
+	for _, pushType := range []string{model.PushTypeClear, model.PushTypeUpdateBadge} {
+		t.Run(pushType+" is a background push", func(t *testing.T) {
+			n := srv.buildNotification(2, &model.PushNotification{DeviceId: "tok", Type: pushType, Badge: 2})
+			assert.Equal(t, apns.PushTypeBackground, n.PushType)
+			assert.Equal(t, apns.PriorityLow, n.Priority)
+
+			aps := marshalPayload(t, n)["aps"].(map[string]any)
+			assert.Equal(t, float64(1), aps["content-available"])
+			assert.Equal(t, float64(2), aps["badge"])
+		})
+	}
+
+	t.Run("messages keep the high priority", func(t *testing.T) {
+		n := srv.buildNotification(2, &model.PushNotification{DeviceId: "tok", Type: model.PushTypeMessage, Message: "hello"})
+		assert.Empty(t, n.PushType)
+		assert.Equal(t, apns.PriorityHigh, n.Priority)
+	})
+
+	t.Run("silent types are configurable", func(t *testing.T) {
+		srv := &AppleNotificationServer{ApplePushSettings: ApplePushSettings{AppleSilentPushTypes: []string{model.PushTypeClear}}}
+		assert.Equal(t, apns.PriorityLow, srv.buildNotification(2, &model.PushNotification{Type: model.PushTypeClear}).Priority)
+		assert.Equal(t, apns.PriorityHigh, srv.buildNotification(2, &model.PushNotification{Type: model.PushTypeUpdateBadge}).Priority)
+
+		srv.ApplePushSettings.AppleSilentPushTypes = []string{}
+		assert.Equal(t, apns.PriorityHigh, srv.buildNotification(2, &model.PushNotification{Type: model.PushTypeClear}).Priority)
+	})
+}
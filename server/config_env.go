@@ -0,0 +1,222 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// CONFIG_ENV_PREFIX prefixes the environment variables overriding config
+// settings, e.g. PUSH_PROXY_LISTEN_ADDRESS for ListenAddress or
+// PUSH_PROXY_APPLE_0_AUTH_KEY_FILE for ApplePushSettings[0].AppleAuthKeyFile.
+const CONFIG_ENV_PREFIX = "PUSH_PROXY"
+
+// Where the effective value of a setting comes from.
+const (
+	CONFIG_SOURCE_FILE    = "file"
+	CONFIG_SOURCE_ENV     = "env"
+	CONFIG_SOURCE_DEFAULT = "default"
+	CONFIG_SOURCE_UNSET   = "unset"
+)
+
+// ConfigSource records where the value of one setting comes from.
+type ConfigSource struct {
+	Setting string
+	EnvName string
+	Source  string
+}
+
+// configField is a leaf setting of the config, together with the
+// environment variable that overrides it.
+type configField struct {
+	value   reflect.Value
+	setting string
+	envName string
+	// jsonPath locates the setting in the config file.
+	jsonPath []any
+}
+
+// walkConfig calls fn for every leaf setting of v. Settings lists, e.g.
+// ApplePushSettings, are walked entry by entry, and entries are added as
+// long as hasEnv reports variables for them.
+func walkConfig(v reflect.Value, setting, envName string, jsonPath []any, strip string, hasEnv func(string) bool, fn func(configField) error) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		fieldSetting := sf.Name
+		if setting != "" {
+			fieldSetting = setting + "." + sf.Name
+		}
+		name := strings.TrimPrefix(sf.Name, strip)
+		if name == "" {
+			name = sf.Name
+		}
+		fieldEnvName := envName + "_" + screamingSnakeCase(name)
+		jsonName := sf.Name
+		if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag != "" {
+			jsonName = tag
+		}
+		fieldJSONPath := append(append([]any{}, jsonPath...), jsonName)
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			elemType := field.Type().Elem()
+			elemStrip := strings.TrimSuffix(elemType.Name(), "PushSettings")
+			listEnvName := envName + "_" + screamingSnakeCase(strings.TrimSuffix(sf.Name, "PushSettings"))
+			for index := 0; index < field.Len() || hasEnv(fmt.Sprintf("%s_%d_", listEnvName, index)); index++ {
+				if index >= field.Len() {
+					field.Set(reflect.Append(field, reflect.New(elemType).Elem()))
+				}
+				err := walkConfig(
+					field.Index(index),
+					fmt.Sprintf("%s[%d]", fieldSetting, index),
+					fmt.Sprintf("%s_%d", listEnvName, index),
+					append(fieldJSONPath, index),
+					elemStrip,
+					hasEnv,
+					fn,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := fn(configField{value: field, setting: fieldSetting, envName: fieldEnvName, jsonPath: fieldJSONPath}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFromEnv parses an environment variable into a setting. Settings that
+// are neither strings, numbers nor booleans are parsed as JSON.
+func setFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		ptr := reflect.New(field.Type())
+		if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		field.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// inJSON reports whether the setting at path is present in the decoded
+// config file. Keys are matched case-insensitively, like encoding/json does.
+func inJSON(raw any, path []any) bool {
+	for _, elem := range path {
+		switch key := elem.(type) {
+		case string:
+			obj, ok := raw.(map[string]any)
+			if !ok {
+				return false
+			}
+			found := false
+			for k, v := range obj {
+				if strings.EqualFold(k, key) {
+					raw, found = v, true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case int:
+			list, ok := raw.([]any)
+			if !ok || key >= len(list) {
+				return false
+			}
+			raw = list[key]
+		}
+	}
+	return true
+}
+
+// applyEnvOverrides overrides the settings of cfg for which an environment
+// variable is set, and returns where the value of each setting comes from.
+// buf is the content of the config file cfg was decoded from.
+func applyEnvOverrides(cfg *ConfigPushProxy, buf []byte, environ []string) ([]ConfigSource, error) {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, CONFIG_ENV_PREFIX+"_") {
+			env[k] = v
+		}
+	}
+	hasEnv := func(prefix string) bool {
+		for k := range env {
+			if strings.HasPrefix(k, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var raw any
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+
+	var sources []ConfigSource
+	err := walkConfig(reflect.ValueOf(cfg).Elem(), "", CONFIG_ENV_PREFIX, nil, "", hasEnv, func(f configField) error {
+		source := CONFIG_SOURCE_UNSET
+		if value, ok := env[f.envName]; ok {
+			if err := setFromEnv(f.value, value); err != nil {
+				return fmt.Errorf("invalid value for %v: %w", f.envName, err)
+			}
+			source = CONFIG_SOURCE_ENV
+		} else if inJSON(raw, f.jsonPath) {
+			source = CONFIG_SOURCE_FILE
+		}
+		sources = append(sources, ConfigSource{Setting: f.setting, EnvName: f.envName, Source: source})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// markDefaults flags the settings that were neither in the file nor in the
+// environment but got a value from LoadConfig's defaults.
+func markDefaults(cfg *ConfigPushProxy, sources []ConfigSource) {
+	values := make(map[string]reflect.Value)
+	_ = walkConfig(reflect.ValueOf(cfg).Elem(), "", CONFIG_ENV_PREFIX, nil, "", func(string) bool { return false }, func(f configField) error {
+		values[f.setting] = f.value
+		return nil
+	})
+
+	for i, source := range sources {
+		if source.Source != CONFIG_SOURCE_UNSET {
+			continue
+		}
+		if value, ok := values[source.Setting]; ok && !value.IsZero() {
+			sources[i].Source = CONFIG_SOURCE_DEFAULT
+		}
+	}
+}
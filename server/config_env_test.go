@@ -0,0 +1,64 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(configFile, []byte(`{
+		"ListenAddress": ":8066",
+		"ApplePushSettings": [
+			{"Type": "apple", "ApplePushTopic": "com.mattermost.Mattermost"}
+		],
+		"AndroidPushSettings": [
+			{"Type": "android", "AndroidApiKey": "old"}
+		]
+	}`), 0600))
+
+	t.Setenv("PUSH_PROXY_LISTEN_ADDRESS", ":9000")
+	t.Setenv("PUSH_PROXY_ENABLE_METRICS", "true")
+	t.Setenv("PUSH_PROXY_REQUEST_SIGNING_SECRETS", `{"server1": ["secret"]}`)
+	t.Setenv("PUSH_PROXY_APPLE_0_AUTH_KEY_FILE", "/keys/AuthKey.p8")
+	t.Setenv("PUSH_PROXY_APPLE_1_TYPE", "apple_rn")
+	t.Setenv("PUSH_PROXY_APPLE_1_PUSH_TOPIC", "com.mattermost.react.native")
+	t.Setenv("PUSH_PROXY_ANDROID_0_API_KEY", "new")
+
+	cfg, err := LoadConfig(configFile)
+	require.NoError(t, err)
+
+	assert.Equal(t, ":9000", cfg.ListenAddress)
+	assert.True(t, cfg.EnableMetrics)
+	assert.Equal(t, map[string][]string{"server1": {"secret"}}, cfg.RequestSigningSecrets)
+	require.Len(t, cfg.ApplePushSettings, 2)
+	assert.Equal(t, "/keys/AuthKey.p8", cfg.ApplePushSettings[0].AppleAuthKeyFile)
+	assert.Equal(t, "com.mattermost.Mattermost", cfg.ApplePushSettings[0].ApplePushTopic)
+	assert.Equal(t, ApplePushSettings{Type: "apple_rn", ApplePushTopic: "com.mattermost.react.native"}, cfg.ApplePushSettings[1])
+	assert.Equal(t, "new", cfg.AndroidPushSettings[0].AndroidAPIKey)
+
+	sources := make(map[string]string)
+	for _, source := range cfg.Sources() {
+		sources[source.Setting] = source.Source
+	}
+	assert.Equal(t, CONFIG_SOURCE_ENV, sources["ListenAddress"])
+	assert.Equal(t, CONFIG_SOURCE_ENV, sources["ApplePushSettings[0].AppleAuthKeyFile"])
+	assert.Equal(t, CONFIG_SOURCE_FILE, sources["ApplePushSettings[0].ApplePushTopic"])
+	assert.Equal(t, CONFIG_SOURCE_ENV, sources["ApplePushSettings[1].Type"])
+	assert.Equal(t, CONFIG_SOURCE_FILE, sources["AndroidPushSettings[0].Type"])
+	assert.Equal(t, CONFIG_SOURCE_DEFAULT, sources["SendTimeoutSec"])
+	assert.Equal(t, CONFIG_SOURCE_UNSET, sources["ThrottleVaryByHeader"])
+
+	t.Run("invalid values are reported", func(t *testing.T) {
+		t.Setenv("PUSH_PROXY_SEND_TIMEOUT_SEC", "soon")
+		_, err := LoadConfig(configFile)
+		require.ErrorContains(t, err, "PUSH_PROXY_SEND_TIMEOUT_SEC")
+	})
+}
@@ -5,6 +5,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,19 +13,57 @@ import (
 )
 
 type ConfigPushProxy struct {
-	AndroidPushSettings     []AndroidPushSettings
-	ListenAddress           string
-	ThrottleVaryByHeader    string
-	LogFileLocation         string
-	SendTimeoutSec          int
-	RetryTimeoutSec         int
-	ApplePushSettings       []ApplePushSettings
+	AndroidPushSettings  []AndroidPushSettings
+	ListenAddress        string
+	ThrottleVaryByHeader string
+	LogFileLocation      string
+	SendTimeoutSec       int
+	RetryTimeoutSec      int
+	ApplePushSettings    []ApplePushSettings
+	// HuaweiPushSettings are push targets delivering to Android devices
+	// without Google services through Huawei Push Kit.
+	HuaweiPushSettings []HuaweiPushSettings `json:",omitempty"`
+	// WebPushSettings are push targets delivering to browser push
+	// subscriptions.
+	WebPushSettings []WebPushSettings `json:",omitempty"`
+	// WNSPushSettings are push targets delivering to Windows apps through
+	// the Windows Notification Service.
+	WNSPushSettings []WNSPushSettings `json:",omitempty"`
+	// WebhookPushSettings are push targets posting notifications to the URL
+	// devices registered, e.g. UnifiedPush distributors.
+	WebhookPushSettings []WebhookPushSettings `json:",omitempty"`
+	// DevPushSettings are push targets for local development, which never
+	// contact Apple or Google.
+	DevPushSettings         []DevPushSettings `json:",omitempty"`
 	EnableMetrics           bool
 	EnableConsoleLog        bool
 	EnableFileLog           bool
 	LogFormat               string // json or plain
 	ThrottlePerSec          int
 	ThrottleMemoryStoreSize int
+	AsyncQueueSize          int
+	AsyncWorkers            int
+	AsyncJobRetentionSec    int
+	// RequestSigningSecrets maps server ids to the secrets their requests
+	// must be signed with. Request signing is disabled when empty.
+	RequestSigningSecrets    map[string][]string
+	RequestSigningMaxSkewSec int
+	TLSCertFile              string
+	TLSKeyFile               string
+	// TLSClientCAFile enables mutual TLS: only clients presenting a
+	// certificate signed by one of these CAs can connect.
+	TLSClientCAFile string
+	// EnableAdminEndpoint exposes POST /admin/reload to requests coming
+	// from the loopback interface and carrying AdminToken.
+	EnableAdminEndpoint bool
+	// AdminToken is the bearer token of requests to the admin endpoint.
+	AdminToken string
+	// SecretsFile is an encrypted file holding the secrets "secret:name"
+	// settings refer to, see SECRETS_KEY_ENV.
+	SecretsFile string
+
+	// sources records where the value of each setting comes from.
+	sources []ConfigSource
 }
 
 type ApplePushSettings struct {
@@ -36,12 +75,166 @@ type ApplePushSettings struct {
 	AppleAuthKeyID          string
 	AppleTeamID             string
 	ApplePushUseDevelopment bool
+	// ApplePushEndpoint overrides the APNs host, e.g. to send to a local
+	// stand-in server, and ApplePushCAFile adds the CAs trusted for it.
+	ApplePushEndpoint string `json:",omitempty"`
+	ApplePushCAFile   string `json:",omitempty"`
+	// AppleSilentPushTypes are the notification types sent as background
+	// pushes with priority 5, DEFAULT_SILENT_PUSH_TYPES when unset.
+	AppleSilentPushTypes []string `json:",omitempty"`
+	// Fallbacks are credentials tried in order when APNs rejects the ones
+	// above. Their Type is the one of this target, and their ApplePushTopic,
+	// endpoint and silent push types default to the ones of this target.
+	Fallbacks []ApplePushSettings `json:",omitempty"`
+
+	// pushCert and authKey hold the content of ApplePushCertPrivate and
+	// AppleAuthKeyFile when they refer to an "env:" or "secret:" secret.
+	pushCert []byte
+	authKey  []byte
+}
+
+// credentialSets returns the settings of the primary credentials followed by
+// those of the fallbacks.
+func (settings ApplePushSettings) credentialSets() []ApplePushSettings {
+	primary := settings
+	primary.Fallbacks = nil
+	sets := []ApplePushSettings{primary}
+	for _, fallback := range settings.Fallbacks {
+		fallback.Type = settings.Type
+		if fallback.ApplePushTopic == "" {
+			fallback.ApplePushTopic = settings.ApplePushTopic
+		}
+		if fallback.ApplePushEndpoint == "" {
+			fallback.ApplePushEndpoint = settings.ApplePushEndpoint
+			fallback.ApplePushCAFile = settings.ApplePushCAFile
+		}
+		if fallback.AppleSilentPushTypes == nil {
+			fallback.AppleSilentPushTypes = settings.AppleSilentPushTypes
+		}
+		fallback.Fallbacks = nil
+		sets = append(sets, fallback)
+	}
+	return sets
 }
 
 type AndroidPushSettings struct {
 	Type                string
 	AndroidAPIKey       string `json:"AndroidApiKey"`
 	ServiceFileLocation string `json:"ServiceFileLocation"`
+	// AndroidPushEndpoint overrides the FCM endpoint, e.g. to send to a
+	// local stand-in server, and AndroidPushCAFile adds the CAs trusted for
+	// it and for the token endpoint of the service account.
+	AndroidPushEndpoint string `json:",omitempty"`
+	AndroidPushCAFile   string `json:",omitempty"`
+	// AndroidSilentPushTypes are the notification types sent with normal
+	// priority, DEFAULT_SILENT_PUSH_TYPES when unset.
+	AndroidSilentPushTypes []string `json:",omitempty"`
+	// Fallbacks are credentials tried in order when FCM rejects the ones
+	// above. Their Type, endpoint and silent push types are the ones of this
+	// target unless they set them.
+	Fallbacks []AndroidPushSettings `json:",omitempty"`
+
+	// serviceFile holds the content of ServiceFileLocation when it refers to
+	// an "env:" or "secret:" secret.
+	serviceFile []byte
+}
+
+// credentialSets returns the settings of the primary credentials followed by
+// those of the fallbacks.
+func (settings AndroidPushSettings) credentialSets() []AndroidPushSettings {
+	primary := settings
+	primary.Fallbacks = nil
+	sets := []AndroidPushSettings{primary}
+	for _, fallback := range settings.Fallbacks {
+		fallback.Type = settings.Type
+		if fallback.AndroidPushEndpoint == "" {
+			fallback.AndroidPushEndpoint = settings.AndroidPushEndpoint
+			fallback.AndroidPushCAFile = settings.AndroidPushCAFile
+		}
+		if fallback.AndroidSilentPushTypes == nil {
+			fallback.AndroidSilentPushTypes = settings.AndroidSilentPushTypes
+		}
+		fallback.Fallbacks = nil
+		sets = append(sets, fallback)
+	}
+	return sets
+}
+
+// HuaweiPushSettings configure a Huawei Push Kit target.
+type HuaweiPushSettings struct {
+	Type string
+	// HuaweiAppID and HuaweiClientSecret are the OAuth client credentials of
+	// the app in AppGallery Connect.
+	HuaweiAppID        string
+	HuaweiClientSecret string
+	// HuaweiPushEndpoint and HuaweiTokenEndpoint override the Push Kit and
+	// OAuth endpoints, e.g. to send to a local stand-in server.
+	HuaweiPushEndpoint  string `json:",omitempty"`
+	HuaweiTokenEndpoint string `json:",omitempty"`
+}
+
+// WebPushSettings configure a Web Push target. The device id of its
+// notifications is the JSON encoded PushSubscription of the browser.
+type WebPushSettings struct {
+	Type string
+	// VAPIDPrivateKey is the base64url encoded P-256 private key the proxy
+	// identifies itself with. Subscriptions must be created with its public
+	// key as applicationServerKey.
+	VAPIDPrivateKey string
+	// VAPIDSubject is a mailto: or https: URL push services can use to
+	// contact the operator.
+	VAPIDSubject string
+	// TTLSec is how long push services keep notifications for offline
+	// browsers, WEBPUSH_DEFAULT_TTL when zero.
+	TTLSec int `json:",omitempty"`
+	// AllowedHosts are the hosts subscription endpoints may point to, the
+	// push services of the major browsers when empty. A pattern starting
+	// with "*." matches every subdomain.
+	AllowedHosts []string `json:",omitempty"`
+}
+
+// WNSPushSettings configure a Windows Notification Service target. The
+// device id of its notifications is the channel URI of the app.
+type WNSPushSettings struct {
+	Type string
+	// WNSPackageSID and WNSClientSecret are the credentials of the app in
+	// Partner Center.
+	WNSPackageSID   string
+	WNSClientSecret string
+	// WNSTokenEndpoint overrides the OAuth endpoint, and WNSChannelHosts
+	// the hosts channel URIs may point to, *.notify.windows.com by default,
+	// e.g. to send to a local stand-in server. WNSCAFile adds the CAs
+	// trusted for them.
+	WNSTokenEndpoint string   `json:",omitempty"`
+	WNSChannelHosts  []string `json:",omitempty"`
+	WNSCAFile        string   `json:",omitempty"`
+}
+
+// WebhookPushSettings configure a webhook target. The device id of its
+// notifications is the URL they are posted to.
+type WebhookPushSettings struct {
+	Type string
+	// AllowedHosts are the hosts device URLs may point to. A pattern
+	// starting with "*." matches every subdomain of the rest.
+	AllowedHosts []string
+	// AllowHTTP accepts plain http URLs, e.g. for relays on a private
+	// network. Only https URLs are accepted otherwise.
+	AllowHTTP bool `json:",omitempty"`
+}
+
+// DevPushSettings configure a development push target. Notifications are
+// rendered as they would be sent to Platform and, depending on Mode, logged
+// or kept in memory for GET /dev/notifications/{type}/{device_id}.
+type DevPushSettings struct {
+	Type string
+	// Mode is DEV_MODE_LOG or DEV_MODE_MOCK.
+	Mode string
+	// Platform is "apple" or "android".
+	Platform       string
+	ApplePushTopic string `json:",omitempty"`
+	// MockHistorySize is the number of notifications kept per device in
+	// DEV_MODE_MOCK, DEV_MOCK_HISTORY_SIZE when zero.
+	MockHistorySize int `json:",omitempty"`
 }
 
 // FindConfigFile searches for the filepath in a list of directories
@@ -60,8 +253,23 @@ func FindConfigFile(fileName string) string {
 	return fileName
 }
 
-// LoadConfig loads the config from the given file path.
+// LoadConfig loads the config from the given file path. Every setting can be
+// overridden with an environment variable, see CONFIG_ENV_PREFIX.
 func LoadConfig(fileName string) (*ConfigPushProxy, error) {
+	cfg, err := loadConfig(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := createLogFile(cfg); err != nil {
+		return nil, err
+	}
+	// The location of the log file may have been defaulted.
+	markDefaults(cfg, cfg.sources)
+	return cfg, nil
+}
+
+// loadConfig loads the config like LoadConfig, without touching the disk.
+func loadConfig(fileName string) (*ConfigPushProxy, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -80,6 +288,15 @@ func LoadConfig(fileName string) (*ConfigPushProxy, error) {
 		return nil, err
 	}
 
+	cfg.sources, err = applyEnvOverrides(cfg, buf, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	if err = resolveSecrets(cfg); err != nil {
+		return nil, err
+	}
+
 	if !cfg.EnableConsoleLog && !cfg.EnableFileLog {
 		cfg.EnableConsoleLog = true
 	}
@@ -97,6 +314,53 @@ func LoadConfig(fileName string) (*ConfigPushProxy, error) {
 		cfg.RetryTimeoutSec = cfg.SendTimeoutSec
 	}
 
+	// Set async send defaults
+	if cfg.AsyncQueueSize == 0 {
+		cfg.AsyncQueueSize = 10000
+	}
+
+	if cfg.AsyncWorkers == 0 {
+		cfg.AsyncWorkers = 20
+	}
+
+	if cfg.AsyncJobRetentionSec == 0 {
+		cfg.AsyncJobRetentionSec = 300
+	}
+
+	if cfg.AsyncQueueSize < 0 || cfg.AsyncWorkers < 0 || cfg.AsyncJobRetentionSec < 0 {
+		return nil, errors.New("AsyncQueueSize, AsyncWorkers and AsyncJobRetentionSec must be positive")
+	}
+
+	if cfg.RequestSigningMaxSkewSec == 0 {
+		cfg.RequestSigningMaxSkewSec = 300
+	}
+
+	for serverId, secrets := range cfg.RequestSigningSecrets {
+		if len(secrets) == 0 || len(secrets) > MAX_SIGNING_SECRETS {
+			return nil, fmt.Errorf("RequestSigningSecrets for server %v must contain 1 to %v secrets", serverId, MAX_SIGNING_SECRETS)
+		}
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+
+	if cfg.EnableAdminEndpoint && cfg.AdminToken == "" {
+		return nil, errors.New("EnableAdminEndpoint requires AdminToken")
+	}
+
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return nil, errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+
+	markDefaults(cfg, cfg.sources)
+
+	return cfg, nil
+}
+
+// createLogFile creates the log file of cfg when file logging is enabled,
+// defaulting its location to the logs directory.
+func createLogFile(cfg *ConfigPushProxy) error {
 	if cfg.EnableFileLog {
 		if cfg.LogFileLocation == "" {
 			// We just do an mkdir -p equivalent.
@@ -113,13 +377,46 @@ func LoadConfig(fileName string) (*ConfigPushProxy, error) {
 		if _, err := os.Stat(cfg.LogFileLocation); os.IsNotExist(err) {
 			f, err := os.Create(cfg.LogFileLocation)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			if err := f.Close(); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
 
-	return cfg, nil
+	return nil
+}
+
+// pushTypes lists the types of every configured push target.
+func (cfg *ConfigPushProxy) pushTypes() []string {
+	var types []string
+	for _, settings := range cfg.ApplePushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.AndroidPushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.HuaweiPushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.WebPushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.WNSPushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.WebhookPushSettings {
+		types = append(types, settings.Type)
+	}
+	for _, settings := range cfg.DevPushSettings {
+		types = append(types, settings.Type)
+	}
+	return types
+}
+
+// Sources returns where the value of each setting comes from: the config
+// file, an environment variable or a default.
+func (cfg *ConfigPushProxy) Sources() []ConfigSource {
+	return cfg.sources
 }
@@ -0,0 +1,326 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// appleTeamIDPattern matches the 10 character identifiers Apple assigns to
+// developer teams.
+var appleTeamIDPattern = regexp.MustCompile(`^[A-Z0-9]{10}$`)
+
+// ValidateConfig loads the config at fileName and checks it beyond what
+// LoadConfig requires for the server to start: every referenced file must be
+// readable and parseable, push target types must be unique, and every
+// setting in the file must be known. Nothing is written to disk, not even
+// the log file. It returns a description of every problem found.
+func ValidateConfig(fileName string) []string {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read config file: %v", err)}
+	}
+
+	var raw any
+	if err = json.Unmarshal(buf, &raw); err != nil {
+		return []string{fmt.Sprintf("config file is not valid JSON: %v", err)}
+	}
+
+	var problems []string
+	problems = append(problems, unknownConfigKeys(raw, reflect.TypeFor[ConfigPushProxy](), "")...)
+
+	// LoadConfig silently clamps the retry timeout, so look at the values
+	// before it does.
+	var requested ConfigPushProxy
+	if err = json.Unmarshal(buf, &requested); err == nil {
+		if _, err = applyEnvOverrides(&requested, buf, os.Environ()); err == nil {
+			sendTimeout := requested.SendTimeoutSec
+			if sendTimeout == 0 {
+				sendTimeout = 30
+			}
+			if requested.RetryTimeoutSec > sendTimeout {
+				problems = append(problems, fmt.Sprintf("RetryTimeoutSec (%v) is greater than SendTimeoutSec (%v) and will be clamped to it", requested.RetryTimeoutSec, sendTimeout))
+			}
+		}
+	}
+
+	cfg, err := loadConfig(fileName)
+	if err != nil {
+		return append(problems, fmt.Sprintf("cannot load config: %v", err))
+	}
+
+	types := make(map[string]string)
+	checkType := func(setting, pushType string) {
+		if pushType == "" {
+			problems = append(problems, setting+".Type is empty")
+			return
+		}
+		if previous, ok := types[pushType]; ok {
+			problems = append(problems, fmt.Sprintf("%v.Type %q is already used by %v, only one of them will be served", setting, pushType, previous))
+			return
+		}
+		types[pushType] = setting
+	}
+
+	for i, settings := range cfg.ApplePushSettings {
+		setting := fmt.Sprintf("ApplePushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		for j, set := range settings.credentialSets() {
+			if j > 0 {
+				setting = fmt.Sprintf("ApplePushSettings[%d].Fallbacks[%d]", i, j-1)
+			}
+			problems = append(problems, validateAppleSettings(setting, set)...)
+		}
+		problems = append(problems, validateSilentPushTypes(fmt.Sprintf("ApplePushSettings[%d].AppleSilentPushTypes", i), settings.AppleSilentPushTypes)...)
+	}
+
+	for i, settings := range cfg.AndroidPushSettings {
+		setting := fmt.Sprintf("AndroidPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		for j, set := range settings.credentialSets() {
+			if j > 0 {
+				setting = fmt.Sprintf("AndroidPushSettings[%d].Fallbacks[%d]", i, j-1)
+			}
+			problems = append(problems, validateAndroidSettings(setting, set)...)
+		}
+		problems = append(problems, validateSilentPushTypes(fmt.Sprintf("AndroidPushSettings[%d].AndroidSilentPushTypes", i), settings.AndroidSilentPushTypes)...)
+	}
+
+	for i, settings := range cfg.HuaweiPushSettings {
+		setting := fmt.Sprintf("HuaweiPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		if settings.HuaweiAppID == "" {
+			problems = append(problems, setting+".HuaweiAppID is empty")
+		}
+		if settings.HuaweiClientSecret == "" {
+			problems = append(problems, setting+".HuaweiClientSecret is empty")
+		}
+	}
+
+	for i, settings := range cfg.WebPushSettings {
+		setting := fmt.Sprintf("WebPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		problems = append(problems, validateWebPushSettings(setting, settings)...)
+	}
+
+	for i, settings := range cfg.WNSPushSettings {
+		setting := fmt.Sprintf("WNSPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		if settings.WNSPackageSID == "" {
+			problems = append(problems, setting+".WNSPackageSID is empty")
+		}
+		if settings.WNSClientSecret == "" {
+			problems = append(problems, setting+".WNSClientSecret is empty")
+		}
+		if settings.WNSCAFile != "" {
+			if _, err := loadCertPool(settings.WNSCAFile); err != nil {
+				problems = append(problems, fmt.Sprintf("%v.WNSCAFile cannot be loaded: %v", setting, err))
+			}
+		}
+	}
+
+	for i, settings := range cfg.WebhookPushSettings {
+		setting := fmt.Sprintf("WebhookPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		if len(settings.AllowedHosts) == 0 {
+			problems = append(problems, setting+".AllowedHosts is empty, no notification will be delivered")
+		}
+	}
+
+	for i, settings := range cfg.DevPushSettings {
+		setting := fmt.Sprintf("DevPushSettings[%d]", i)
+		checkType(setting, settings.Type)
+		problems = append(problems, validateDevSettings(setting, settings)...)
+	}
+
+	if cfg.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("TLSCertFile/TLSKeyFile cannot be loaded: %v", err))
+		}
+	}
+	if cfg.TLSClientCAFile != "" {
+		if _, err := loadCertPool(cfg.TLSClientCAFile); err != nil {
+			problems = append(problems, fmt.Sprintf("TLSClientCAFile cannot be loaded: %v", err))
+		}
+	}
+
+	return problems
+}
+
+// validateSilentPushTypes reports the notification types shown to the user
+// among silentTypes, as they cannot be sent as background pushes.
+func validateSilentPushTypes(setting string, silentTypes []string) []string {
+	var problems []string
+	for _, pushType := range silentTypes {
+		if pushType == model.PushTypeMessage || pushType == model.PushTypeSession {
+			problems = append(problems, fmt.Sprintf("%v includes %q, which is shown to the user and cannot be sent silently", setting, pushType))
+		}
+	}
+	return problems
+}
+
+func validateAppleSettings(setting string, settings ApplePushSettings) []string {
+	var problems []string
+
+	if settings.ApplePushCAFile != "" {
+		if _, err := loadCertPool(settings.ApplePushCAFile); err != nil {
+			problems = append(problems, fmt.Sprintf("%v.ApplePushCAFile cannot be loaded: %v", setting, err))
+		}
+	}
+
+	if settings.ApplePushTopic == "" {
+		problems = append(problems, setting+".ApplePushTopic is empty")
+	}
+
+	switch {
+	case settings.AppleAuthKeyFile != "":
+		if _, err := settings.loadAuthKey(); err != nil {
+			problems = append(problems, fmt.Sprintf("%v.AppleAuthKeyFile cannot be loaded: %v", setting, err))
+		}
+		if settings.AppleAuthKeyID == "" {
+			problems = append(problems, setting+".AppleAuthKeyID is empty")
+		}
+		if !appleTeamIDPattern.MatchString(settings.AppleTeamID) {
+			problems = append(problems, fmt.Sprintf("%v.AppleTeamID %q is not a 10 character Apple team id", setting, settings.AppleTeamID))
+		}
+	case settings.ApplePushCertPrivate != "":
+		cert, err := settings.loadPushCert()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v.ApplePushCertPrivate cannot be loaded: %v", setting, err))
+			break
+		}
+		if cert.Leaf == nil {
+			break
+		}
+		if time.Now().After(cert.Leaf.NotAfter) {
+			problems = append(problems, fmt.Sprintf("%v.ApplePushCertPrivate expired on %v", setting, cert.Leaf.NotAfter.Format(time.RFC3339)))
+		}
+		if err := checkAppleCertificateTopic(cert.Leaf, settings.ApplePushTopic); err != nil {
+			problems = append(problems, fmt.Sprintf("%v.%v", setting, err))
+		}
+	default:
+		problems = append(problems, setting+" has neither AppleAuthKeyFile nor ApplePushCertPrivate set")
+	}
+
+	return problems
+}
+
+func validateAndroidSettings(setting string, settings AndroidPushSettings) []string {
+	var problems []string
+
+	if settings.AndroidPushCAFile != "" {
+		if _, err := loadCertPool(settings.AndroidPushCAFile); err != nil {
+			problems = append(problems, fmt.Sprintf("%v.AndroidPushCAFile cannot be loaded: %v", setting, err))
+		}
+	}
+
+	if settings.ServiceFileLocation == "" {
+		return append(problems, setting+".ServiceFileLocation is empty")
+	}
+
+	jsonKey, err := readSecretFile(settings.ServiceFileLocation, settings.serviceFile)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%v.ServiceFileLocation cannot be read: %v", setting, err))
+	}
+	if _, err := google.JWTConfigFromJSON(jsonKey, scope); err != nil {
+		return append(problems, fmt.Sprintf("%v.ServiceFileLocation is not a valid service account file: %v", setting, err))
+	}
+	return problems
+}
+
+func validateWebPushSettings(setting string, settings WebPushSettings) []string {
+	var problems []string
+	if settings.VAPIDPrivateKey == "" {
+		problems = append(problems, setting+".VAPIDPrivateKey is empty")
+	} else if _, err := parseVAPIDPrivateKey(settings.VAPIDPrivateKey); err != nil {
+		problems = append(problems, fmt.Sprintf("%v.VAPIDPrivateKey is not a base64url encoded P-256 private key: %v", setting, err))
+	}
+	if !strings.HasPrefix(settings.VAPIDSubject, "mailto:") && !strings.HasPrefix(settings.VAPIDSubject, "https://") {
+		problems = append(problems, fmt.Sprintf("%v.VAPIDSubject %q is neither a mailto: nor an https: URL", setting, settings.VAPIDSubject))
+	}
+	return problems
+}
+
+func validateDevSettings(setting string, settings DevPushSettings) []string {
+	var problems []string
+	if settings.Mode != DEV_MODE_LOG && settings.Mode != DEV_MODE_MOCK {
+		problems = append(problems, fmt.Sprintf("%v.Mode %q is neither %q nor %q", setting, settings.Mode, DEV_MODE_LOG, DEV_MODE_MOCK))
+	}
+	if settings.Platform != model.PushNotifyApple && settings.Platform != model.PushNotifyAndroid {
+		problems = append(problems, fmt.Sprintf("%v.Platform %q is neither %q nor %q", setting, settings.Platform, model.PushNotifyApple, model.PushNotifyAndroid))
+	}
+	return problems
+}
+
+// unknownConfigKeys lists the keys of raw that do not match any field of t,
+// the type raw is decoded into.
+func unknownConfigKeys(raw any, t reflect.Type, path string) []string {
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]any)
+		if !ok {
+			return nil
+		}
+
+		var unknown []string
+		for _, key := range slices.Sorted(maps.Keys(obj)) {
+			value := obj[key]
+			field, found := configFieldByJSONName(t, key)
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			if !found {
+				unknown = append(unknown, fmt.Sprintf("unknown setting %v", keyPath))
+				continue
+			}
+			unknown = append(unknown, unknownConfigKeys(value, field.Type, keyPath)...)
+		}
+		return unknown
+	case reflect.Slice:
+		list, ok := raw.([]any)
+		if !ok {
+			return nil
+		}
+
+		var unknown []string
+		for i, value := range list {
+			unknown = append(unknown, unknownConfigKeys(value, t.Elem(), fmt.Sprintf("%v[%d]", path, i))...)
+		}
+		return unknown
+	}
+	return nil
+}
+
+// configFieldByJSONName finds the exported field of t that encoding/json
+// would decode key into.
+func configFieldByJSONName(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
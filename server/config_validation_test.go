@@ -0,0 +1,147 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestAuthKey(t *testing.T, dir string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, "AuthKey.p8")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return keyFile
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := writeTestAuthKey(t, dir)
+	writeConfig := func(t *testing.T, content string) string {
+		configFile := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(configFile, []byte(content), 0600))
+		return configFile
+	}
+
+	t.Run("valid config", func(t *testing.T) {
+		configFile := writeConfig(t, `{
+			"ListenAddress": ":8066",
+			"ApplePushSettings": [{
+				"Type": "apple",
+				"ApplePushTopic": "com.mattermost.Mattermost",
+				"AppleAuthKeyFile": "`+keyFile+`",
+				"AppleAuthKeyID": "ABC123DEFG",
+				"AppleTeamID": "TEAM123456"
+			}]
+		}`)
+
+		assert.Empty(t, ValidateConfig(configFile))
+	})
+
+	t.Run("every problem is reported", func(t *testing.T) {
+		configFile := writeConfig(t, `{
+			"ListenAddress": ":8066",
+			"SendTimeoutSec": 10,
+			"RetryTimeoutSec": 20,
+			"ThrotlePerSec": 300,
+			"ApplePushSettings": [{
+				"Type": "mobile",
+				"ApplePushTopic": "com.mattermost.Mattermost",
+				"AppleAuthKeyFile": "`+keyFile+`",
+				"AppleAuthKeyID": "ABC123DEFG",
+				"AppleTeamID": "team",
+				"AppleTopic": "typo"
+			}],
+			"AndroidPushSettings": [{
+				"Type": "mobile",
+				"ServiceFileLocation": "`+filepath.Join(dir, "missing.json")+`",
+				"AndroidSilentPushTypes": ["clear", "session"]
+			}],
+			"DevPushSettings": [{
+				"Type": "mobile_dev",
+				"Mode": "send",
+				"Platform": "ios"
+			}]
+		}`)
+
+		problems := ValidateConfig(configFile)
+		require.Len(t, problems, 9)
+		assert.Contains(t, problems, "unknown setting ThrotlePerSec")
+		assert.Contains(t, problems, "unknown setting ApplePushSettings[0].AppleTopic")
+		assert.Contains(t, problems, "RetryTimeoutSec (20) is greater than SendTimeoutSec (10) and will be clamped to it")
+		assert.Contains(t, problems, `ApplePushSettings[0].AppleTeamID "team" is not a 10 character Apple team id`)
+		assert.Contains(t, problems, `AndroidPushSettings[0].Type "mobile" is already used by ApplePushSettings[0], only one of them will be served`)
+		assert.True(t, slices.ContainsFunc(problems, func(problem string) bool {
+			return strings.HasPrefix(problem, "AndroidPushSettings[0].ServiceFileLocation cannot be read")
+		}))
+		assert.Contains(t, problems, `AndroidPushSettings[0].AndroidSilentPushTypes includes "session", which is shown to the user and cannot be sent silently`)
+		assert.Contains(t, problems, `DevPushSettings[0].Mode "send" is neither "log" nor "mock"`)
+		assert.Contains(t, problems, `DevPushSettings[0].Platform "ios" is neither "apple" nor "android"`)
+	})
+
+	t.Run("unreadable credentials", func(t *testing.T) {
+		garbage := filepath.Join(dir, "garbage.pem")
+		require.NoError(t, os.WriteFile(garbage, []byte("not a key"), 0600))
+
+		configFile := writeConfig(t, `{
+			"ApplePushSettings": [
+				{"Type": "apple", "ApplePushTopic": "com.mattermost.Mattermost", "AppleAuthKeyFile": "`+garbage+`", "AppleAuthKeyID": "ABC123DEFG", "AppleTeamID": "TEAM123456"},
+				{"Type": "apple_rn", "ApplePushTopic": "com.mattermost.react.native", "ApplePushCertPrivate": "`+garbage+`"},
+				{"Type": "apple_empty"}
+			],
+			"AndroidPushSettings": [
+				{"Type": "android", "ServiceFileLocation": "`+garbage+`"}
+			]
+		}`)
+
+		problems := ValidateConfig(configFile)
+		require.Len(t, problems, 5)
+		assert.Contains(t, problems[0], "ApplePushSettings[0].AppleAuthKeyFile cannot be loaded")
+		assert.Contains(t, problems[1], "ApplePushSettings[1].ApplePushCertPrivate cannot be loaded")
+		assert.Equal(t, "ApplePushSettings[2].ApplePushTopic is empty", problems[2])
+		assert.Equal(t, "ApplePushSettings[2] has neither AppleAuthKeyFile nor ApplePushCertPrivate set", problems[3])
+		assert.Contains(t, problems[4], "AndroidPushSettings[0].ServiceFileLocation is not a valid service account file")
+	})
+
+	t.Run("nothing is written to disk", func(t *testing.T) {
+		logFile := filepath.Join(t.TempDir(), "push_proxy.log")
+		configFile := writeConfig(t, `{"EnableFileLog": true, "LogFileLocation": "`+logFile+`"}`)
+
+		assert.Empty(t, ValidateConfig(configFile))
+		assert.NoFileExists(t, logFile)
+	})
+
+	t.Run("negative async settings", func(t *testing.T) {
+		for _, setting := range []string{"AsyncQueueSize", "AsyncWorkers", "AsyncJobRetentionSec"} {
+			problems := ValidateConfig(writeConfig(t, `{"`+setting+`": -1}`))
+			require.Len(t, problems, 1, setting)
+			assert.Contains(t, problems[0], "AsyncQueueSize, AsyncWorkers and AsyncJobRetentionSec must be positive")
+		}
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		configFile := writeConfig(t, `{"ListenAddress": `)
+
+		problems := ValidateConfig(configFile)
+		require.Len(t, problems, 1)
+		assert.Contains(t, problems[0], "config file is not valid JSON")
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// CREDENTIALS_EXPIRY_WARNING is how long before push credentials expire
+	// a warning starts being logged.
+	CREDENTIALS_EXPIRY_WARNING = 30 * 24 * time.Hour
+	// CREDENTIALS_EXPIRY_CHECK_INTERVAL is how often the expiry of push
+	// credentials is checked and reported.
+	CREDENTIALS_EXPIRY_CHECK_INTERVAL = time.Hour
+)
+
+var (
+	// appleTopicsOID is the extension listing the topics of an APNs
+	// certificate valid for several topics.
+	appleTopicsOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 3, 6}
+	// uidOID is the subject attribute holding the bundle id of single topic
+	// APNs certificates.
+	uidOID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+)
+
+// expiringCredentials is implemented by the push targets whose credentials
+// expire.
+type expiringCredentials interface {
+	// credentialsExpiry returns when the credentials expire, or the zero
+	// time if they don't.
+	credentialsExpiry() time.Time
+}
+
+// appleCertificateTopics returns the topics an APNs certificate can send
+// to.
+func appleCertificateTopics(cert *x509.Certificate) []string {
+	var topics []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(appleTopicsOID) {
+			continue
+		}
+
+		// The extension is a sequence of topics, each followed by a sequence
+		// of the push types it allows.
+		var values []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &values); err != nil {
+			return nil
+		}
+		for _, value := range values {
+			if value.Class == asn1.ClassUniversal && value.Tag == asn1.TagUTF8String {
+				topics = append(topics, string(value.Bytes))
+			}
+		}
+		return topics
+	}
+
+	for _, name := range cert.Subject.Names {
+		if uid, ok := name.Value.(string); ok && name.Type.Equal(uidOID) {
+			topics = append(topics, uid)
+		}
+	}
+	return topics
+}
+
+// checkAppleCertificateTopic returns an error when the topics of an APNs
+// certificate are known and do not include topic.
+func checkAppleCertificateTopic(cert *x509.Certificate, topic string) error {
+	topics := appleCertificateTopics(cert)
+	if len(topics) > 0 && !slices.Contains(topics, topic) {
+		return fmt.Errorf("ApplePushTopic %v is not covered by the certificate, whose topics are %v", topic, topics)
+	}
+	return nil
+}
+
+// checkCredentialsExpiry reports how long the credentials of every push
+// target remain valid, and logs the ones that expire soon.
+func (s *Server) checkCredentialsExpiry() {
+	report, _ := s.health.report()
+	if s.metrics != nil {
+		s.metrics.resetCredentialsExpiry()
+	}
+
+	for _, target := range report.Targets {
+		if target.CredentialsExpiry == nil {
+			continue
+		}
+
+		remaining := time.Until(*target.CredentialsExpiry)
+		if s.metrics != nil {
+			s.metrics.setCredentialsExpiry(target.Platform, target.Type, remaining.Seconds())
+		}
+
+		fields := []mlog.Field{
+			mlog.String("type", target.Type),
+			mlog.String("platform", target.Platform),
+			mlog.Time("expires_at", *target.CredentialsExpiry),
+		}
+		switch {
+		case remaining <= 0:
+			s.logger.Error("Push credentials have expired", fields...)
+		case remaining <= CREDENTIALS_EXPIRY_WARNING:
+			s.logger.Warn("Push credentials expire soon", append(fields, mlog.Int("days_left", int(remaining.Hours()/24)))...)
+		}
+	}
+}
+
+func (s *Server) watchCredentialsExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.checkCredentialsExpiry()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// writeTestAPNsCert writes a PEM file holding a certificate and its key, like
+// the ones exported from the Apple developer portal. The topics are listed in
+// the topics extension, or as the subject UID when there is a single one.
+func writeTestAPNsCert(t *testing.T, dir string, notAfter time.Time, topics ...string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: " + topics[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	if len(topics) == 1 {
+		tmpl.Subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: uidOID, Value: topics[0]}}
+	} else {
+		var values []any
+		for _, topic := range topics {
+			values = append(values, asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte(topic)})
+			values = append(values, []asn1.RawValue{{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: []byte("app")}})
+		}
+		ext, err := asn1.Marshal(values)
+		require.NoError(t, err)
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: appleTopicsOID, Value: ext}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "apns.pem")
+	content := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	require.NoError(t, os.WriteFile(certFile, content, 0600))
+	return certFile
+}
+
+func TestAppleCertificateTopics(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+	notAfter := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+
+	for name, topics := range map[string][]string{
+		"single topic":    {"com.mattermost.Mattermost"},
+		"multiple topics": {"com.mattermost.rnbeta", "com.mattermost.Mattermost", "com.mattermost.Mattermost.voip"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			certFile := writeTestAPNsCert(t, t.TempDir(), notAfter, topics...)
+
+			srv := NewAppleNotificationServer(ApplePushSettings{
+				Type:                 "apple",
+				ApplePushCertPrivate: certFile,
+				ApplePushTopic:       "com.mattermost.Mattermost",
+			}, logger, nil, 30, 8)
+			require.NoError(t, srv.Initialize())
+			assert.True(t, notAfter.Equal(srv.credentialsExpiry()))
+
+			srv = NewAppleNotificationServer(ApplePushSettings{
+				Type:                 "apple",
+				ApplePushCertPrivate: certFile,
+				ApplePushTopic:       "com.mattermost.other",
+			}, logger, nil, 30, 8)
+			assert.ErrorContains(t, srv.Initialize(), "ApplePushTopic com.mattermost.other is not covered by the certificate")
+		})
+	}
+}
+
+func TestCheckCredentialsExpiry(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := writeTestAPNsCert(t, dir, time.Now().Add(10*24*time.Hour), "com.mattermost.Mattermost")
+
+	srv := New(&ConfigPushProxy{
+		ApplePushSettings: []ApplePushSettings{{
+			Type:                 "apple",
+			ApplePushCertPrivate: certFile,
+			ApplePushTopic:       "com.mattermost.Mattermost",
+		}},
+		SendTimeoutSec:  30,
+		RetryTimeoutSec: 8,
+	}, logger)
+	srv.metrics = newMetrics()
+	defer srv.metrics.shutdown()
+
+	srv.pushTargets, srv.targetSettings = srv.buildPushTargets(srv.cfg, nil, nil)
+	srv.checkCredentialsExpiry()
+
+	remaining := testutil.ToFloat64(srv.metrics.metricCredentialsExpiry.WithLabelValues(model.PushNotifyApple, "apple"))
+	assert.InDelta(t, (10 * 24 * time.Hour).Seconds(), remaining, 60)
+
+	report, _ := srv.health.report()
+	require.Len(t, report.Targets, 1)
+	require.NotNil(t, report.Targets[0].CredentialsExpiry)
+
+	// Targets that are not configured anymore stop being reported.
+	srv.health.retain(nil)
+	srv.checkCredentialsExpiry()
+	assert.Equal(t, 0, testutil.CollectAndCount(srv.metrics.metricCredentialsExpiry))
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"os"
+	"time"
+)
+
+// CREDENTIALS_RELOAD_INTERVAL is how often the credential files of the push
+// targets are checked for changes.
+const CREDENTIALS_RELOAD_INTERVAL = 30 * time.Second
+
+// credentialModTimes returns the modification time of every file that
+// exists. Empty names are skipped.
+func credentialModTimes(files []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// credentialsChanged reports whether a credential file of any target was
+// modified since the target was initialized.
+func credentialsChanged(targetSettings map[string]pushTargetSettings) bool {
+	for _, ts := range targetSettings {
+		for file, modTime := range ts.modTimes {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			if !info.ModTime().Equal(modTime) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reloadChangedCredentials initializes again the push targets whose
+// credential files changed, and swaps them in. Sends already in progress
+// finish with the previous client, and a target whose new credentials fail to
+// initialize keeps the previous one.
+func (s *Server) reloadChangedCredentials() {
+	s.reloadMut.Lock()
+	defer s.reloadMut.Unlock()
+
+	s.mut.RLock()
+	cfg := s.cfg
+	current := s.pushTargets
+	currentSettings := s.targetSettings
+	s.mut.RUnlock()
+
+	if !credentialsChanged(currentSettings) {
+		return
+	}
+
+	s.logger.Info("Credential files changed, reloading the affected push targets")
+	targets, targetSettings := s.buildPushTargets(cfg, current, currentSettings)
+
+	s.mut.Lock()
+	s.pushTargets = targets
+	s.targetSettings = targetSettings
+	s.mut.Unlock()
+
+	s.checkCredentialsExpiry()
+}
+
+func (s *Server) watchCredentialFiles(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.reloadChangedCredentials()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestReloadChangedCredentials(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := writeTestAPNsCert(t, dir, time.Now().Add(24*time.Hour), "com.mattermost.Mattermost")
+	serviceFile := filepath.Join(dir, "service-account.json")
+	buf, err := json.Marshal(serviceAccount{Type: "service_account", ProjectID: "sample"})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(serviceFile, buf, 0600))
+
+	srv := New(&ConfigPushProxy{
+		ApplePushSettings: []ApplePushSettings{
+			{Type: "apple", ApplePushCertPrivate: certFile, ApplePushTopic: "com.mattermost.Mattermost"},
+		},
+		AndroidPushSettings: []AndroidPushSettings{
+			{Type: "android", ServiceFileLocation: serviceFile},
+		},
+		SendTimeoutSec:  30,
+		RetryTimeoutSec: 8,
+	}, logger)
+	srv.pushTargets, srv.targetSettings = srv.buildPushTargets(srv.cfg, nil, nil)
+
+	apple, ok := srv.pushTarget("apple")
+	require.True(t, ok)
+	android, ok := srv.pushTarget("android")
+	require.True(t, ok)
+
+	t.Run("nothing changed", func(t *testing.T) {
+		srv.reloadChangedCredentials()
+
+		reloaded, _ := srv.pushTarget("apple")
+		assert.Same(t, apple, reloaded)
+	})
+
+	t.Run("only the target whose file changed is initialized again", func(t *testing.T) {
+		writeTestAPNsCert(t, dir, time.Now().Add(48*time.Hour), "com.mattermost.Mattermost")
+		require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(time.Minute)))
+		srv.reloadChangedCredentials()
+
+		reloaded, _ := srv.pushTarget("apple")
+		assert.NotSame(t, apple, reloaded)
+		apple = reloaded
+		reloaded, _ = srv.pushTarget("android")
+		assert.Same(t, android, reloaded)
+
+		report, _ := srv.health.report()
+		for _, target := range report.Targets {
+			if target.Type == "apple" {
+				require.NotNil(t, target.CredentialsExpiry)
+				assert.WithinDuration(t, time.Now().Add(48*time.Hour), *target.CredentialsExpiry, time.Minute)
+			}
+		}
+	})
+
+	t.Run("invalid new credentials keep the previous client", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(certFile, []byte("truncated"), 0600))
+		require.NoError(t, os.Chtimes(certFile, time.Now(), time.Now().Add(2*time.Minute)))
+		srv.reloadChangedCredentials()
+
+		reloaded, _ := srv.pushTarget("apple")
+		assert.Same(t, apple, reloaded)
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	apns "github.com/sideshow/apns2"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// DEV_MODE_LOG logs the payload of every notification.
+	DEV_MODE_LOG = "log"
+	// DEV_MODE_MOCK keeps the last notifications of every device in memory.
+	DEV_MODE_MOCK         = "mock"
+	DEV_MOCK_HISTORY_SIZE = 20
+)
+
+// DevNotification is a notification received by a development target, with
+// the payload it would have been sent with.
+type DevNotification struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	AppVersion int             `json:"app_version"`
+	Platform   string          `json:"platform"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// renderedAppleNotification is what would be sent to APNs: the headers of
+// the request and its body.
+type renderedAppleNotification struct {
+	Topic    string         `json:"topic"`
+	PushType apns.EPushType `json:"push_type,omitempty"`
+	Priority int            `json:"priority"`
+	Payload  any            `json:"payload"`
+}
+
+// DevNotificationServer is a push target for local development. It renders
+// notifications as the Apple or Android target would, but never sends them.
+type DevNotificationServer struct {
+	logger          *mlog.Logger
+	DevPushSettings DevPushSettings
+
+	mut           sync.Mutex
+	notifications map[string][]DevNotification
+}
+
+func NewDevNotificationServer(settings DevPushSettings, logger *mlog.Logger) *DevNotificationServer {
+	return &DevNotificationServer{
+		DevPushSettings: settings,
+		logger:          logger,
+		notifications:   make(map[string][]DevNotification),
+	}
+}
+
+func (me *DevNotificationServer) Initialize() error {
+	if me.DevPushSettings.Mode != DEV_MODE_LOG && me.DevPushSettings.Mode != DEV_MODE_MOCK {
+		return fmt.Errorf("development push target has an unknown Mode %q for type=%v, must be %q or %q", me.DevPushSettings.Mode, me.DevPushSettings.Type, DEV_MODE_LOG, DEV_MODE_MOCK)
+	}
+	if me.DevPushSettings.Platform != model.PushNotifyApple && me.DevPushSettings.Platform != model.PushNotifyAndroid {
+		return fmt.Errorf("development push target has an unknown Platform %q for type=%v, must be %q or %q", me.DevPushSettings.Platform, me.DevPushSettings.Type, model.PushNotifyApple, model.PushNotifyAndroid)
+	}
+
+	me.logger.Warn(
+		"Initializing development notification server, notifications of this type are never delivered",
+		mlog.String("type", me.DevPushSettings.Type),
+		mlog.String("mode", me.DevPushSettings.Mode),
+		mlog.String("platform", me.DevPushSettings.Platform),
+	)
+	return nil
+}
+
+// render returns the payload msg would be sent with.
+func (me *DevNotificationServer) render(appVersion int, msg *model.PushNotification) (json.RawMessage, error) {
+	if me.DevPushSettings.Platform == model.PushNotifyAndroid {
+		android := &AndroidNotificationServer{}
+		if msg.Type == PUSH_TYPE_CALL_DISMISS {
+			return json.Marshal(android.buildCallDismissMessage(msg))
+		}
+		if msg.Transport == model.PushTransportVoIP {
+			return json.Marshal(android.buildVoIPMessage(msg))
+		}
+		return json.Marshal(android.buildMessage(msg))
+	}
+
+	apple := &AppleNotificationServer{ApplePushSettings: ApplePushSettings{ApplePushTopic: me.DevPushSettings.ApplePushTopic}}
+	var notification *apns.Notification
+	switch {
+	case msg.Type == PUSH_TYPE_CALL_DISMISS:
+		notification = apple.buildCallDismissNotification(msg)
+	case msg.Transport == model.PushTransportVoIP:
+		notification = apple.buildVoIPNotification(msg)
+	case isLiveActivityTransport(msg.Transport):
+		var err error
+		if notification, err = apple.buildLiveActivityNotification(msg); err != nil {
+			return nil, err
+		}
+	default:
+		notification = apple.buildNotification(appVersion, msg)
+	}
+	return json.Marshal(renderedAppleNotification{
+		Topic:    notification.Topic,
+		PushType: notification.PushType,
+		Priority: notification.Priority,
+		Payload:  notification.Payload,
+	})
+}
+
+func (me *DevNotificationServer) SendNotification(appVersion int, msg *model.PushNotification) PushResponse {
+	rendered, err := me.render(appVersion, msg)
+	if err != nil {
+		me.logger.Error("Failed to render development push notification", mlog.String("type", me.DevPushSettings.Type), mlog.Err(err))
+		return NewErrorPushResponse(err.Error())
+	}
+
+	if me.DevPushSettings.Mode == DEV_MODE_LOG {
+		me.logger.Info(
+			"Development push notification",
+			mlog.String("type", me.DevPushSettings.Type),
+			mlog.String("platform", me.DevPushSettings.Platform),
+			mlog.String("did", msg.DeviceId),
+			mlog.String("payload", string(rendered)),
+		)
+		return NewOkPushResponse()
+	}
+
+	historySize := me.DevPushSettings.MockHistorySize
+	if historySize <= 0 {
+		historySize = DEV_MOCK_HISTORY_SIZE
+	}
+
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	notifications := append(me.notifications[msg.DeviceId], DevNotification{
+		ReceivedAt: time.Now(),
+		AppVersion: appVersion,
+		Platform:   me.DevPushSettings.Platform,
+		Payload:    rendered,
+	})
+	if len(notifications) > historySize {
+		notifications = notifications[len(notifications)-historySize:]
+	}
+	me.notifications[msg.DeviceId] = notifications
+	return NewOkPushResponse()
+}
+
+// Notifications returns the last notifications received for deviceID, the
+// oldest first.
+func (me *DevNotificationServer) Notifications(deviceID string) []DevNotification {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	return append([]DevNotification{}, me.notifications[deviceID]...)
+}
+
+// hasMockDevTarget reports whether settings configure a DEV_MODE_MOCK target.
+func hasMockDevTarget(settings []DevPushSettings) bool {
+	for _, settings := range settings {
+		if settings.Mode == DEV_MODE_MOCK {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDevNotifications lists the notifications a mock target received for
+// a device.
+func (s *Server) handleDevNotifications(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	s.mut.RLock()
+	target := s.pushTargets[vars["type"]]
+	s.mut.RUnlock()
+	if hs, ok := target.(*healthTrackingServer); ok {
+		target = hs.NotificationServer
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	dev, ok := target.(*DevNotificationServer)
+	if !ok || dev.DevPushSettings.Mode != DEV_MODE_MOCK {
+		w.WriteHeader(http.StatusNotFound)
+		rMsg := fmt.Sprintf("Failed because %v is not a mock push target", vars["type"])
+		if err := json.NewEncoder(w).Encode(NewErrorPushResponseWithReason(rMsg, REASON_UNKNOWN_PLATFORM, false)); err != nil {
+			s.logger.Error("Failed to write response", mlog.Err(err))
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(dev.Notifications(vars["device_id"])); err != nil {
+		s.logger.Error("Failed to write response", mlog.Err(err))
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestDevNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	cfg := &ConfigPushProxy{
+		DevPushSettings: []DevPushSettings{
+			{Type: "apple_dev", Mode: DEV_MODE_MOCK, Platform: model.PushNotifyApple, ApplePushTopic: "com.mattermost.Mattermost", MockHistorySize: 2},
+			{Type: "android_dev", Mode: DEV_MODE_MOCK, Platform: model.PushNotifyAndroid},
+			{Type: "android_log", Mode: DEV_MODE_LOG, Platform: model.PushNotifyAndroid},
+			{Type: "broken", Mode: "send", Platform: model.PushNotifyAndroid},
+		},
+	}
+	srv := New(cfg, logger)
+	srv.pushTargets, srv.targetSettings = srv.buildPushTargets(cfg, nil, nil)
+
+	_, ok := srv.pushTarget("broken")
+	assert.False(t, ok)
+
+	listNotifications := func(pushType, deviceID string) (int, []DevNotification) {
+		req := httptest.NewRequest(http.MethodGet, "/dev/notifications/"+pushType+"/"+deviceID, nil)
+		req = mux.SetURLVars(req, map[string]string{"type": pushType, "device_id": deviceID})
+		res := httptest.NewRecorder()
+		srv.handleDevNotifications(res, req)
+
+		var notifications []DevNotification
+		if res.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(res.Body.Bytes(), &notifications))
+		}
+		return res.Code, notifications
+	}
+
+	t.Run("apple payloads are kept per device", func(t *testing.T) {
+		target, ok := srv.pushTarget("apple_dev")
+		require.True(t, ok)
+		for _, message := range []string{"one", "two", "three"} {
+			resp := target.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, Message: message, ChannelId: "channel"})
+			assert.Equal(t, NewOkPushResponse(), resp)
+		}
+
+		code, notifications := listNotifications("apple_dev", "device")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, notifications, 2)
+
+		var rendered struct {
+			Topic   string `json:"topic"`
+			Payload struct {
+				APS struct {
+					Alert string `json:"alert"`
+				} `json:"aps"`
+				ChannelID string `json:"channel_id"`
+			} `json:"payload"`
+		}
+		require.NoError(t, json.Unmarshal(notifications[1].Payload, &rendered))
+		assert.Equal(t, "com.mattermost.Mattermost", rendered.Topic)
+		assert.Equal(t, "three", rendered.Payload.APS.Alert)
+		assert.Equal(t, "channel", rendered.Payload.ChannelID)
+		assert.Equal(t, model.PushNotifyApple, notifications[1].Platform)
+
+		_, notifications = listNotifications("apple_dev", "other")
+		assert.Empty(t, notifications)
+	})
+
+	t.Run("android payloads are rendered as FCM messages", func(t *testing.T) {
+		target, ok := srv.pushTarget("android_dev")
+		require.True(t, ok)
+		target.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, ChannelId: "channel"})
+
+		code, notifications := listNotifications("android_dev", "device")
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, notifications, 1)
+
+		var message struct {
+			Token string            `json:"token"`
+			Data  map[string]string `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(notifications[0].Payload, &message))
+		assert.Equal(t, "device", message.Token)
+		assert.Equal(t, "channel", message.Data["channel_id"])
+	})
+
+	t.Run("only mock targets can be listed", func(t *testing.T) {
+		target, ok := srv.pushTarget("android_log")
+		require.True(t, ok)
+		assert.Equal(t, NewOkPushResponse(), target.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage}))
+
+		code, _ := listNotifications("android_log", "device")
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = listNotifications("unknown", "device")
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+	t.Run("listing is only served with a mock target", func(t *testing.T) {
+		assert.True(t, hasMockDevTarget(cfg.DevPushSettings))
+		assert.False(t, hasMockDevTarget(cfg.DevPushSettings[2:]))
+		assert.False(t, hasMockDevTarget(nil))
+	})
+
+	t.Run("listing requires a signature", func(t *testing.T) {
+		srv.cfg.RequestSigningSecrets = map[string][]string{"server1": {"secret"}}
+		srv.cfg.RequestSigningMaxSkewSec = 60
+		defer func() { srv.cfg.RequestSigningSecrets = nil }()
+		handler := statusCodesMiddleware(srv.requireSignature(srv.handleDevNotifications))
+
+		req := httptest.NewRequest(http.MethodGet, "/dev/notifications/apple_dev/device", nil)
+		req = mux.SetURLVars(req, map[string]string{"type": "apple_dev", "device_id": "device"})
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HEADER_SERVER_ID, "server1")
+		req.Header.Set(HEADER_TIMESTAMP, timestamp)
+		req.Header.Set(HEADER_SIGNATURE, signRequest("secret", timestamp, http.MethodGet, "/dev/notifications/apple_dev/device", nil))
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost-push-proxy/internal/pushtest"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestAppleEndpointOverride(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	apns := pushtest.NewAPNs()
+	defer apns.Close()
+
+	newServer := func(t *testing.T, caFile string, sendTimeoutSec int) *AppleNotificationServer {
+		srv := NewAppleNotificationServer(ApplePushSettings{
+			Type:              "apple",
+			ApplePushTopic:    "com.mattermost.Mattermost",
+			AppleAuthKeyFile:  writeTestAuthKey(t, t.TempDir()),
+			AppleAuthKeyID:    "ABC123DEFG",
+			AppleTeamID:       "TEAM123456",
+			ApplePushEndpoint: apns.URL() + "/",
+			ApplePushCAFile:   caFile,
+		}, logger, nil, sendTimeoutSec, 1)
+		require.NoError(t, srv.Initialize())
+		return srv
+	}
+	srv := newServer(t, apns.CAFile(), 30)
+
+	t.Run("payload", func(t *testing.T) {
+		apns.Reset()
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, Message: "hello", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		requests := apns.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "device", requests[0].DeviceToken)
+		assert.Equal(t, "com.mattermost.Mattermost", requests[0].Header.Get("apns-topic"))
+		assert.Contains(t, requests[0].Header.Get("authorization"), "bearer ")
+
+		var payload map[string]any
+		require.NoError(t, json.Unmarshal(requests[0].Body, &payload))
+		assert.Equal(t, "channel", payload["channel_id"])
+	})
+
+	t.Run("live activity broadcast", func(t *testing.T) {
+		apns.Reset()
+		resp := srv.SendNotification(2, &model.PushNotification{
+			DeviceId:  "channel-id",
+			Type:      model.PushTypeMessage,
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST,
+			Message:   `{"event":"update","content_state":{"participants":3}}`,
+		})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		requests := apns.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "/4/broadcasts/apps/com.mattermost.Mattermost", requests[0].Path)
+		assert.Equal(t, "channel-id", requests[0].Header.Get("apns-channel-id"))
+		assert.Equal(t, "liveactivity", requests[0].Header.Get("apns-push-type"))
+		assert.Equal(t, "5", requests[0].Header.Get("apns-priority"))
+		assert.Contains(t, requests[0].Header.Get("authorization"), "bearer ")
+
+		var payload map[string]any
+		require.NoError(t, json.Unmarshal(requests[0].Body, &payload))
+		assert.Equal(t, "update", payload["aps"].(map[string]any)["event"])
+	})
+
+	t.Run("live activity broadcast failure", func(t *testing.T) {
+		apns.Reset()
+		apns.ReplyTo("channel-id", pushtest.APNsTooManyRequests)
+
+		resp := srv.SendNotification(2, &model.PushNotification{
+			DeviceId:  "channel-id",
+			Type:      model.PushTypeMessage,
+			Transport: PUSH_TRANSPORT_LIVE_ACTIVITY_BROADCAST,
+			Message:   `{"event":"end","content_state":{}}`,
+		})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "APNS_TOO_MANY_REQUESTS", resp[PUSH_REASON])
+	})
+
+	for name, tc := range map[string]struct {
+		reply     pushtest.Reply
+		status    string
+		reason    string
+		retryable bool
+	}{
+		"bad device token":  {pushtest.APNsBadDeviceToken, PUSH_STATUS_REMOVE, "APNS_BAD_DEVICE_TOKEN", false},
+		"unregistered":      {pushtest.APNsUnregistered, PUSH_STATUS_REMOVE, "APNS_UNREGISTERED", false},
+		"too many requests": {pushtest.APNsTooManyRequests, PUSH_STATUS_FAIL, "APNS_TOO_MANY_REQUESTS", true},
+		"internal error":    {pushtest.APNsInternalServerError, PUSH_STATUS_FAIL, "APNS_INTERNAL_SERVER_ERROR", true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			apns.Reset()
+			apns.ReplyTo("device", tc.reply)
+
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+			assert.Equal(t, tc.status, resp[PUSH_STATUS])
+			assert.Equal(t, tc.reason, resp[PUSH_REASON])
+			if tc.status == PUSH_STATUS_FAIL {
+				assert.Equal(t, tc.retryable, resp[PUSH_RETRYABLE] == "true")
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		apns.Reset()
+		apns.ReplyToAll(pushtest.Timeout(5 * time.Second))
+		srv := newServer(t, apns.CAFile(), 1)
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, REASON_TRANSPORT_TIMEOUT, resp[PUSH_REASON])
+	})
+
+	t.Run("untrusted endpoint", func(t *testing.T) {
+		apns.Reset()
+		srv := newServer(t, "", 1)
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Empty(t, apns.Requests())
+	})
+}
+
+func TestAndroidEndpointOverride(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	fcm := pushtest.NewFCM()
+	defer fcm.Close()
+
+	serviceFile, err := fcm.ServiceAccountFile("sample")
+	require.NoError(t, err)
+	newServer := func(t *testing.T, sendTimeoutSec int) *AndroidNotificationServer {
+		srv := NewAndroidNotificationServer(AndroidPushSettings{
+			Type:                "android",
+			ServiceFileLocation: serviceFile,
+			AndroidPushEndpoint: fcm.Endpoint(),
+			AndroidPushCAFile:   fcm.CAFile(),
+		}, logger, nil, sendTimeoutSec, 1)
+		require.NoError(t, srv.Initialize())
+		return srv
+	}
+	srv := newServer(t, 30)
+
+	t.Run("payload", func(t *testing.T) {
+		fcm.Reset()
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, Message: "hello", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		requests := fcm.Requests()
+		require.Len(t, requests, 1)
+		assert.Equal(t, "device", requests[0].DeviceToken)
+
+		var message struct {
+			Data    map[string]string `json:"data"`
+			Android struct {
+				Priority string `json:"priority"`
+			} `json:"android"`
+		}
+		require.NoError(t, json.Unmarshal(requests[0].Body, &message))
+		assert.Equal(t, "channel", message.Data["channel_id"])
+		assert.Equal(t, "high", message.Android.Priority)
+	})
+
+	t.Run("voip transport", func(t *testing.T) {
+		fcm.Reset()
+		m := newMetrics()
+		defer m.shutdown()
+		srv := newServer(t, 30)
+		srv.metrics = m
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, SubType: model.PushSubTypeCalls, ChannelId: "channel", Transport: model.PushTransportVoIP})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		requests := fcm.Requests()
+		require.Len(t, requests, 1)
+		var message struct {
+			Data    map[string]string `json:"data"`
+			Android struct {
+				Priority    string `json:"priority"`
+				TTL         string `json:"ttl"`
+				CollapseKey string `json:"collapse_key"`
+			} `json:"android"`
+		}
+		require.NoError(t, json.Unmarshal(requests[0].Body, &message))
+		assert.Equal(t, "voip", message.Data["transport"])
+		assert.Equal(t, "high", message.Android.Priority)
+		assert.Equal(t, "0s", message.Android.TTL)
+		assert.Equal(t, "voip_channel", message.Android.CollapseKey)
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.metricSuccess.WithLabelValues(model.PushNotifyAndroid, model.PushTypeMessage, string(model.PushTransportVoIP))))
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.metricSuccess.WithLabelValues(model.PushNotifyAndroid, model.PushTypeMessage, string(model.PushTransportStandard))))
+	})
+
+	for name, tc := range map[string]struct {
+		reply     pushtest.Reply
+		status    string
+		reason    string
+		retryable bool
+	}{
+		"unregistered":     {pushtest.FCMUnregistered, PUSH_STATUS_REMOVE, "FCM_UNREGISTERED", false},
+		"sender id":        {pushtest.FCMSenderIDMismatch, PUSH_STATUS_REMOVE, "FCM_SENDER_ID_MISMATCH", false},
+		"invalid argument": {pushtest.FCMInvalidArgument, PUSH_STATUS_FAIL, "FCM_INVALID_ARGUMENT", false},
+		"third party auth": {pushtest.FCMThirdPartyAuth, PUSH_STATUS_FAIL, "FCM_THIRD_PARTY_AUTH_ERROR", false},
+		"quota exceeded":   {pushtest.FCMQuotaExceeded, PUSH_STATUS_FAIL, "FCM_QUOTA_EXCEEDED", true},
+		"internal error":   {pushtest.FCMInternal, PUSH_STATUS_FAIL, "FCM_INTERNAL", true},
+		"unknown error":    {pushtest.Reply{Status: http.StatusConflict}, PUSH_STATUS_FAIL, "FCM_UNKNOWN", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fcm.Reset()
+			fcm.ReplyTo("device", tc.reply)
+
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+			assert.Equal(t, tc.status, resp[PUSH_STATUS])
+			assert.Equal(t, tc.reason, resp[PUSH_REASON])
+			if tc.status == PUSH_STATUS_FAIL {
+				assert.Equal(t, tc.retryable, resp[PUSH_RETRYABLE] == "true")
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		fcm.Reset()
+		fcm.ReplyToAll(pushtest.Timeout(5 * time.Second))
+		srv := newServer(t, 1)
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, REASON_TRANSPORT_TIMEOUT, resp[PUSH_REASON])
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// CREDENTIALS_FAILOVER_RETRY is how long a target keeps sending with
+// fallback credentials before trying its primary credentials again.
+const CREDENTIALS_FAILOVER_RETRY = 15 * time.Minute
+
+// credentialsRejectedReasons are the reasons with which push services reject
+// the credentials of a request, rather than the notification itself.
+var credentialsRejectedReasons = map[string]bool{
+	"APNS_INVALID_PROVIDER_TOKEN":      true,
+	"APNS_EXPIRED_PROVIDER_TOKEN":      true,
+	"APNS_MISSING_PROVIDER_TOKEN":      true,
+	"APNS_BAD_CERTIFICATE":             true,
+	"APNS_BAD_CERTIFICATE_ENVIRONMENT": true,
+	"APNS_FORBIDDEN":                   true,
+	"FCM_THIRD_PARTY_AUTH_ERROR":       true,
+	"FCM_UNAUTHENTICATED":              true,
+	"FCM_PERMISSION_DENIED":            true,
+	"FCM_TOKEN_SOURCE_ERROR":           true,
+	"HUAWEI_TOKEN_SOURCE_ERROR":        true,
+	"WNS_TOKEN_SOURCE_ERROR":           true,
+}
+
+func isCredentialsRejected(resp PushResponse) bool {
+	return resp[PUSH_STATUS] == PUSH_STATUS_FAIL && credentialsRejectedReasons[resp[PUSH_REASON]]
+}
+
+// failoverNotificationServer sends with the first of several credential sets
+// of a push target that is not rejected. Once a set is rejected, the
+// following ones are used until the primary set is tried again after
+// CREDENTIALS_FAILOVER_RETRY.
+type failoverNotificationServer struct {
+	pushType string
+	servers  []NotificationServer
+	logger   *mlog.Logger
+
+	mut          sync.Mutex
+	active       int
+	failedOverAt time.Time
+}
+
+func newFailoverNotificationServer(pushType string, servers []NotificationServer, logger *mlog.Logger) *failoverNotificationServer {
+	return &failoverNotificationServer{
+		pushType: pushType,
+		servers:  servers,
+		logger:   logger,
+	}
+}
+
+// Initialize initializes every credential set, and drops the ones that fail
+// to. It only fails when none of them can be used.
+func (me *failoverNotificationServer) Initialize() error {
+	var servers []NotificationServer
+	var errs []error
+	for i, server := range me.servers {
+		if err := server.Initialize(); err != nil {
+			me.logger.Warn("Failed to initialize credentials, skipping them", mlog.String("type", me.pushType), mlog.Int("credentials", i), mlog.Err(err))
+			errs = append(errs, fmt.Errorf("credentials %d: %w", i, err))
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return errors.Join(errs...)
+	}
+
+	me.servers = servers
+	return nil
+}
+
+func (me *failoverNotificationServer) SendNotification(appVersion int, msg *model.PushNotification) PushResponse {
+	me.mut.Lock()
+	start := me.active
+	if start != 0 && time.Since(me.failedOverAt) > CREDENTIALS_FAILOVER_RETRY {
+		start = 0
+	}
+	me.mut.Unlock()
+
+	var resp PushResponse
+	for attempt := range me.servers {
+		i := (start + attempt) % len(me.servers)
+		resp = me.servers[i].SendNotification(appVersion, msg)
+		if !isCredentialsRejected(resp) {
+			me.use(start, i)
+			return resp
+		}
+
+		me.logger.Warn("Push credentials rejected",
+			mlog.String("type", me.pushType),
+			mlog.Int("credentials", i),
+			mlog.String("reason", resp[PUSH_REASON]),
+		)
+	}
+	return resp
+}
+
+// use records the credential set that was last accepted, when sending
+// started with the set at index start. The primary set is retried
+// CREDENTIALS_FAILOVER_RETRY after failing over, or after a retry failed
+// over again, not after the last send through a fallback.
+func (me *failoverNotificationServer) use(start, i int) {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+
+	if i != 0 && i != start {
+		me.failedOverAt = time.Now()
+	}
+	if i != me.active {
+		me.logger.Warn("Switched push credentials", mlog.String("type", me.pushType), mlog.Int("from", me.active), mlog.Int("to", i))
+		me.active = i
+	}
+}
+
+// credentialsExpiry returns when the first of the credential sets expires.
+func (me *failoverNotificationServer) credentialsExpiry() time.Time {
+	var expiry time.Time
+	for _, server := range me.servers {
+		ec, ok := server.(expiringCredentials)
+		if !ok {
+			continue
+		}
+		if t := ec.credentialsExpiry(); !t.IsZero() && (expiry.IsZero() || t.Before(expiry)) {
+			expiry = t
+		}
+	}
+	return expiry
+}
+
+// newAppleTarget returns the push target for settings, failing over to its
+// fallback credentials if it has any.
+func (s *Server) newAppleTarget(settings ApplePushSettings, cfg *ConfigPushProxy) NotificationServer {
+	sets := settings.credentialSets()
+	if len(sets) == 1 {
+		return NewAppleNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+	}
+
+	servers := make([]NotificationServer, 0, len(sets))
+	for _, set := range sets {
+		servers = append(servers, NewAppleNotificationServer(set, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec))
+	}
+	return newFailoverNotificationServer(settings.Type, servers, s.logger)
+}
+
+// newAndroidTarget returns the push target for settings, failing over to its
+// fallback credentials if it has any.
+func (s *Server) newAndroidTarget(settings AndroidPushSettings, cfg *ConfigPushProxy) NotificationServer {
+	sets := settings.credentialSets()
+	if len(sets) == 1 {
+		return NewAndroidNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+	}
+
+	servers := make([]NotificationServer, 0, len(sets))
+	for _, set := range sets {
+		servers = append(servers, NewAndroidNotificationServer(set, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec))
+	}
+	return newFailoverNotificationServer(settings.Type, servers, s.logger)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+type failingNotificationServer struct {
+	recordingNotificationServer
+}
+
+func (fs *failingNotificationServer) Initialize() error {
+	return errors.New("bad credentials")
+}
+
+func TestFailoverNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	rejected := NewErrorPushResponseWithReason("unknown send response error", upstreamReason("APNS", "InvalidProviderToken"), false)
+	primary := &recordingNotificationServer{responses: map[string]PushResponse{"dev": rejected}}
+	fallback := &recordingNotificationServer{responses: map[string]PushResponse{"bad": NewRemovePushResponse()}}
+	srv := newFailoverNotificationServer("apple", []NotificationServer{primary, fallback}, logger)
+	require.NoError(t, srv.Initialize())
+
+	msg := &model.PushNotification{DeviceId: "dev"}
+
+	t.Run("rejected credentials fail over", func(t *testing.T) {
+		assert.Equal(t, NewOkPushResponse(), srv.SendNotification(2, msg))
+		assert.Equal(t, []string{"dev"}, primary.sent)
+		assert.Equal(t, []string{"dev"}, fallback.sent)
+	})
+
+	t.Run("the fallback keeps being used", func(t *testing.T) {
+		assert.Equal(t, NewRemovePushResponse(), srv.SendNotification(2, &model.PushNotification{DeviceId: "bad"}))
+		assert.Equal(t, []string{"dev"}, primary.sent)
+		assert.Equal(t, []string{"dev", "bad"}, fallback.sent)
+	})
+
+	t.Run("sends through the fallback don't delay retrying the primary", func(t *testing.T) {
+		failedOverAt := srv.failedOverAt
+		srv.failedOverAt = failedOverAt.Add(-CREDENTIALS_FAILOVER_RETRY + time.Minute)
+		for range 3 {
+			assert.Equal(t, NewRemovePushResponse(), srv.SendNotification(2, &model.PushNotification{DeviceId: "bad"}))
+		}
+		assert.Equal(t, []string{"dev"}, primary.sent)
+
+		// The retry interval elapses while the fallback is in use.
+		srv.failedOverAt = srv.failedOverAt.Add(-2 * time.Minute)
+		assert.Equal(t, NewOkPushResponse(), srv.SendNotification(2, msg))
+		assert.Equal(t, []string{"dev", "dev"}, primary.sent, "the primary must be tried again")
+		assert.Equal(t, 1, srv.active)
+		assert.WithinDuration(t, time.Now(), srv.failedOverAt, time.Second, "failing over again restarts the retry interval")
+
+		assert.Equal(t, NewOkPushResponse(), srv.SendNotification(2, msg))
+		assert.Equal(t, []string{"dev", "dev"}, primary.sent)
+	})
+
+	t.Run("the primary is tried again later", func(t *testing.T) {
+		srv.failedOverAt = time.Now().Add(-CREDENTIALS_FAILOVER_RETRY - time.Minute)
+		primary.responses = nil
+
+		assert.Equal(t, NewOkPushResponse(), srv.SendNotification(2, msg))
+		assert.Equal(t, []string{"dev", "dev", "dev"}, primary.sent)
+		assert.Equal(t, 0, srv.active)
+	})
+
+	t.Run("every credential rejected", func(t *testing.T) {
+		fallbackRejected := NewErrorPushResponseWithReason("error", upstreamReason("FCM", thirdPartyAuthError), false)
+		srv := newFailoverNotificationServer("android", []NotificationServer{
+			&recordingNotificationServer{responses: map[string]PushResponse{"dev": rejected}},
+			&recordingNotificationServer{responses: map[string]PushResponse{"dev": fallbackRejected}},
+		}, logger)
+		require.NoError(t, srv.Initialize())
+
+		assert.Equal(t, fallbackRejected, srv.SendNotification(2, msg))
+	})
+
+	t.Run("credentials failing to initialize are skipped", func(t *testing.T) {
+		working := &recordingNotificationServer{}
+		srv := newFailoverNotificationServer("apple", []NotificationServer{&failingNotificationServer{}, working}, logger)
+		require.NoError(t, srv.Initialize())
+
+		srv.SendNotification(2, msg)
+		assert.Equal(t, []string{"dev"}, working.sent)
+
+		srv = newFailoverNotificationServer("apple", []NotificationServer{&failingNotificationServer{}, &failingNotificationServer{}}, logger)
+		assert.ErrorContains(t, srv.Initialize(), "credentials 1: bad credentials")
+	})
+}
+
+func TestCredentialSets(t *testing.T) {
+	settings := ApplePushSettings{
+		Type:                 "apple",
+		ApplePushTopic:       "com.mattermost.Mattermost",
+		AppleAuthKeyFile:     "/keys/new.p8",
+		AppleSilentPushTypes: []string{"clear"},
+		Fallbacks: []ApplePushSettings{
+			{ApplePushCertPrivate: "/keys/legacy.pem"},
+			{Type: "ignored", ApplePushTopic: "com.mattermost.rnbeta", AppleAuthKeyFile: "/keys/beta.p8", AppleSilentPushTypes: []string{}},
+		},
+	}
+
+	assert.Equal(t, []ApplePushSettings{
+		{Type: "apple", ApplePushTopic: "com.mattermost.Mattermost", AppleAuthKeyFile: "/keys/new.p8", AppleSilentPushTypes: []string{"clear"}},
+		{Type: "apple", ApplePushTopic: "com.mattermost.Mattermost", ApplePushCertPrivate: "/keys/legacy.pem", AppleSilentPushTypes: []string{"clear"}},
+		{Type: "apple", ApplePushTopic: "com.mattermost.rnbeta", AppleAuthKeyFile: "/keys/beta.p8", AppleSilentPushTypes: []string{}},
+	}, settings.credentialSets())
+}
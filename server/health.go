@@ -0,0 +1,270 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// HEALTH_WINDOW_SIZE is the number of recent sends a target's failure
+	// rate is computed from.
+	HEALTH_WINDOW_SIZE = 50
+	// A target is not usable when more than HEALTH_MAX_FAILURE_RATE of its
+	// recent sends failed, once at least HEALTH_MIN_SAMPLES were made.
+	HEALTH_MIN_SAMPLES      = 10
+	HEALTH_MAX_FAILURE_RATE = 0.9
+	// HEALTH_SAMPLE_MAX_AGE is how long a send counts towards the failure
+	// rate. Old samples expire so that an unready instance, that no longer
+	// gets traffic, becomes ready again once the outage is over.
+	HEALTH_SAMPLE_MAX_AGE = 5 * time.Minute
+
+	HEALTH_STATUS_OK          = "OK"
+	HEALTH_STATUS_UNAVAILABLE = "UNAVAILABLE"
+)
+
+// TargetHealth describes the state of one configured push target.
+type TargetHealth struct {
+	Type              string     `json:"type"`
+	Platform          string     `json:"platform"`
+	Initialized       bool       `json:"initialized"`
+	InitError         string     `json:"init_error,omitempty"`
+	CredentialsExpiry *time.Time `json:"credentials_expiry,omitempty"`
+	LastSuccess       *time.Time `json:"last_success,omitempty"`
+	LastFailure       *time.Time `json:"last_failure,omitempty"`
+	Samples           int        `json:"samples"`
+	FailureRate       float64    `json:"failure_rate"`
+	Usable            bool       `json:"usable"`
+}
+
+// HealthReport is the reply of the health endpoints.
+type HealthReport struct {
+	Status  string         `json:"status"`
+	Targets []TargetHealth `json:"targets"`
+}
+
+type targetHealth struct {
+	mut               sync.Mutex
+	pushType          string
+	platform          string
+	initialized       bool
+	initError         string
+	credentialsExpiry time.Time
+	lastSuccess       time.Time
+	lastFailure       time.Time
+	outcomes          [HEALTH_WINDOW_SIZE]sendOutcome
+	next              int
+	samples           int
+}
+
+type sendOutcome struct {
+	failed bool
+	at     time.Time
+}
+
+func (th *targetHealth) record(failed bool) {
+	th.mut.Lock()
+	defer th.mut.Unlock()
+
+	now := time.Now()
+	if failed {
+		th.lastFailure = now
+	} else {
+		th.lastSuccess = now
+	}
+	th.outcomes[th.next] = sendOutcome{failed: failed, at: now}
+	th.next = (th.next + 1) % HEALTH_WINDOW_SIZE
+	if th.samples < HEALTH_WINDOW_SIZE {
+		th.samples++
+	}
+}
+
+func (th *targetHealth) report() TargetHealth {
+	th.mut.Lock()
+	defer th.mut.Unlock()
+
+	report := TargetHealth{
+		Type:        th.pushType,
+		Platform:    th.platform,
+		Initialized: th.initialized,
+		InitError:   th.initError,
+	}
+	if !th.credentialsExpiry.IsZero() {
+		credentialsExpiry := th.credentialsExpiry
+		report.CredentialsExpiry = &credentialsExpiry
+	}
+	if !th.lastSuccess.IsZero() {
+		lastSuccess := th.lastSuccess
+		report.LastSuccess = &lastSuccess
+	}
+	if !th.lastFailure.IsZero() {
+		lastFailure := th.lastFailure
+		report.LastFailure = &lastFailure
+	}
+
+	failures := 0
+	for _, outcome := range th.outcomes[:th.samples] {
+		if time.Since(outcome.at) > HEALTH_SAMPLE_MAX_AGE {
+			continue
+		}
+		report.Samples++
+		if outcome.failed {
+			failures++
+		}
+	}
+	if report.Samples > 0 {
+		report.FailureRate = float64(failures) / float64(report.Samples)
+	}
+
+	report.Usable = th.initialized && (report.Samples < HEALTH_MIN_SAMPLES || report.FailureRate <= HEALTH_MAX_FAILURE_RATE)
+	return report
+}
+
+// healthRegistry keeps track of every configured push target, whether or
+// not it could be initialized.
+type healthRegistry struct {
+	mut     sync.RWMutex
+	targets map[string]*targetHealth
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{
+		targets: make(map[string]*targetHealth),
+	}
+}
+
+func (hr *healthRegistry) target(pushType, platform string) *targetHealth {
+	hr.mut.Lock()
+	defer hr.mut.Unlock()
+
+	th, ok := hr.targets[pushType]
+	if !ok {
+		th = &targetHealth{pushType: pushType, platform: platform}
+		hr.targets[pushType] = th
+	}
+	return th
+}
+
+// initialized records the outcome of a target's Initialize call.
+func (hr *healthRegistry) initialized(pushType, platform string, server NotificationServer, err error) {
+	th := hr.target(pushType, platform)
+
+	th.mut.Lock()
+	defer th.mut.Unlock()
+	th.initialized = err == nil
+	th.initError = ""
+	th.credentialsExpiry = time.Time{}
+	if err != nil {
+		th.initError = err.Error()
+		return
+	}
+	if ec, ok := server.(expiringCredentials); ok {
+		th.credentialsExpiry = ec.credentialsExpiry()
+	}
+}
+
+// retain forgets about the targets whose type is not listed.
+func (hr *healthRegistry) retain(pushTypes []string) {
+	hr.mut.Lock()
+	defer hr.mut.Unlock()
+
+	for pushType := range hr.targets {
+		if !slices.Contains(pushTypes, pushType) {
+			delete(hr.targets, pushType)
+		}
+	}
+}
+
+// track wraps server so that the outcome of every send is recorded.
+func (hr *healthRegistry) track(pushType, platform string, server NotificationServer) NotificationServer {
+	return &healthTrackingServer{
+		NotificationServer: server,
+		health:             hr.target(pushType, platform),
+	}
+}
+
+// report returns the state of every target, and whether all of them are
+// usable.
+func (hr *healthRegistry) report() (HealthReport, bool) {
+	hr.mut.RLock()
+	targets := make([]TargetHealth, 0, len(hr.targets))
+	for _, th := range hr.targets {
+		targets = append(targets, th.report())
+	}
+	hr.mut.RUnlock()
+
+	slices.SortFunc(targets, func(a, b TargetHealth) int {
+		return strings.Compare(a.Type, b.Type)
+	})
+
+	// Every type is a different app, that the other targets of its platform
+	// cannot deliver to.
+	ready := !slices.ContainsFunc(targets, func(target TargetHealth) bool {
+		return !target.Usable
+	})
+
+	report := HealthReport{Status: HEALTH_STATUS_OK, Targets: targets}
+	if !ready {
+		report.Status = HEALTH_STATUS_UNAVAILABLE
+	}
+	return report, ready
+}
+
+type healthTrackingServer struct {
+	NotificationServer
+	health *targetHealth
+}
+
+func (hs *healthTrackingServer) Platform() string {
+	return hs.health.platform
+}
+
+func (hs *healthTrackingServer) SendNotification(appVersion int, msg *model.PushNotification) PushResponse {
+	resp := hs.NotificationServer.SendNotification(appVersion, msg)
+	// A REMOVE response means the target is working, the device token is
+	// not. Failures that are not worth retrying, e.g. bad requests, are
+	// caused by the caller and say nothing about the target, unless its
+	// credentials were rejected.
+	switch {
+	case resp[PUSH_STATUS] != PUSH_STATUS_FAIL:
+		hs.health.record(false)
+	case resp[PUSH_RETRYABLE] == "true" || isCredentialsRejected(resp):
+		hs.health.record(true)
+	}
+	return resp
+}
+
+// handleLiveness reports the health of every target. It always replies 200
+// as long as the process can serve requests.
+func (s *Server) handleLiveness(w http.ResponseWriter, _ *http.Request) {
+	report, _ := s.health.report()
+	s.writeHealthReport(w, http.StatusOK, report)
+}
+
+// handleReadiness replies 503 when any configured target is not usable, so
+// that traffic is routed to other instances.
+func (s *Server) handleReadiness(w http.ResponseWriter, _ *http.Request) {
+	report, ready := s.health.report()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeHealthReport(w, status, report)
+}
+
+func (s *Server) writeHealthReport(w http.ResponseWriter, status int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		s.logger.Error("Failed to write response", mlog.Err(err))
+	}
+}
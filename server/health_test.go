@@ -0,0 +1,140 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	srv := New(&ConfigPushProxy{}, logger)
+
+	probe := func(handler http.HandlerFunc) (int, HealthReport) {
+		res := httptest.NewRecorder()
+		handler(res, httptest.NewRequest(http.MethodGet, "/", nil))
+		var report HealthReport
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&report))
+		return res.Code, report
+	}
+
+	// A target that failed to initialize makes the instance unready, even
+	// when another target of its platform works.
+	srv.health.initialized("apple", model.PushNotifyApple, nil, errors.New("missing certificate"))
+	srv.health.initialized("apple_rn", model.PushNotifyApple, nil, nil)
+	apple := srv.health.track("apple_rn", model.PushNotifyApple, &recordingNotificationServer{
+		responses: map[string]PushResponse{
+			"broken":  NewErrorPushResponseWithReason("", "APNS_INTERNAL_SERVER_ERROR", true),
+			"revoked": NewErrorPushResponseWithReason("", "APNS_BAD_CERTIFICATE", false),
+			"invalid": NewErrorPushResponseWithReason("", "APNS_BAD_DEVICE_TOKEN", false),
+			"stale":   NewRemovePushResponse(),
+		},
+	})
+	srv.health.initialized("android", model.PushNotifyAndroid, nil, nil)
+
+	code, report := probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HEALTH_STATUS_UNAVAILABLE, report.Status)
+	require.Len(t, report.Targets, 3)
+	assert.Equal(t, "android", report.Targets[0].Type)
+	assert.Equal(t, "apple", report.Targets[1].Type)
+	assert.False(t, report.Targets[1].Usable)
+	assert.Equal(t, "missing certificate", report.Targets[1].InitError)
+	assert.True(t, report.Targets[2].Usable)
+
+	srv.health.initialized("apple", model.PushNotifyApple, nil, nil)
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HEALTH_STATUS_OK, report.Status)
+
+	// Removed tokens don't count against the target.
+	for range HEALTH_WINDOW_SIZE {
+		apple.SendNotification(1, &model.PushNotification{DeviceId: "stale"})
+	}
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Zero(t, report.Targets[2].FailureRate)
+	assert.NotNil(t, report.Targets[2].LastSuccess)
+
+	// Neither do requests the caller got wrong.
+	for range HEALTH_WINDOW_SIZE {
+		apple.SendNotification(1, &model.PushNotification{DeviceId: "invalid"})
+	}
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Zero(t, report.Targets[2].FailureRate)
+
+	// Rejected credentials do.
+	for range HEALTH_WINDOW_SIZE {
+		apple.SendNotification(1, &model.PushNotification{DeviceId: "revoked"})
+	}
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, float64(1), report.Targets[2].FailureRate)
+
+	for range HEALTH_WINDOW_SIZE {
+		apple.SendNotification(1, &model.PushNotification{DeviceId: "broken"})
+	}
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HEALTH_STATUS_UNAVAILABLE, report.Status)
+	assert.Equal(t, float64(1), report.Targets[2].FailureRate)
+	assert.Equal(t, HEALTH_WINDOW_SIZE, report.Targets[2].Samples)
+	assert.False(t, report.Targets[2].Usable)
+
+	// Liveness keeps replying 200 with the same report.
+	code, report = probe(srv.handleLiveness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HEALTH_STATUS_UNAVAILABLE, report.Status)
+
+	// The target becomes ready again once its failures are old enough, even
+	// though it gets no traffic while it is not ready.
+	th := srv.health.target("apple_rn", model.PushNotifyApple)
+	th.mut.Lock()
+	for i := range th.outcomes {
+		th.outcomes[i].at = th.outcomes[i].at.Add(-HEALTH_SAMPLE_MAX_AGE - time.Second)
+	}
+	th.mut.Unlock()
+	code, report = probe(srv.handleReadiness)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Zero(t, report.Targets[2].Samples)
+	assert.True(t, report.Targets[2].Usable)
+}
+
+func TestHealthProbesAreNotThrottled(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	srv := New(&ConfigPushProxy{}, logger)
+	srv.router = mux.NewRouter()
+	srv.router.HandleFunc("/healthz", srv.handleLiveness).Methods("GET")
+	srv.router.HandleFunc("/readyz", srv.handleReadiness).Methods("GET")
+	srv.throttled = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	for path, expected := range map[string]int{
+		"/healthz":          http.StatusOK,
+		"/readyz":           http.StatusOK,
+		"/api/v1/send_push": http.StatusTooManyRequests,
+		"/version":          http.StatusTooManyRequests,
+	} {
+		res := httptest.NewRecorder()
+		srv.serveHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expected, res.Code, path)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// PUSH_NOTIFY_HUAWEI is the platform of Huawei Push Kit targets in
+	// metrics and health reports.
+	PUSH_NOTIFY_HUAWEI    = "huawei"
+	HUAWEI_PUSH_ENDPOINT  = "https://push-api.cloud.huawei.com"
+	HUAWEI_TOKEN_ENDPOINT = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	HUAWEI_SUCCESS_CODE   = "80000000"
+)
+
+// huaweiErrorReasons names the Push Kit result codes the proxy acts upon.
+var huaweiErrorReasons = map[string]string{
+	"80100000": "ILLEGAL_TOKEN",
+	"80100001": "INVALID_ARGUMENT",
+	"80100003": "INVALID_MESSAGE",
+	"80100004": "INVALID_TTL",
+	"80200001": "AUTH_ERROR",
+	"80200003": "AUTH_TOKEN_EXPIRED",
+	"80300002": "PERMISSION_DENIED",
+	"80300007": "INVALID_TOKEN",
+	"80300008": "PAYLOAD_TOO_LARGE",
+	"81000001": "INTERNAL",
+}
+
+// huaweiTokenRejectedCodes are the result codes asking for a new access
+// token.
+var huaweiTokenRejectedCodes = map[string]bool{
+	"80200001": true,
+	"80200003": true,
+}
+
+type huaweiMessage struct {
+	Data    string            `json:"data"`
+	Token   []string          `json:"token"`
+	Android huaweiAndroidConf `json:"android"`
+}
+
+type huaweiAndroidConf struct {
+	Urgency string `json:"urgency"`
+}
+
+type huaweiResponse struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"requestId"`
+}
+
+// HuaweiNotificationServer delivers data messages through Huawei Push Kit,
+// to Android devices without Google services.
+type HuaweiNotificationServer struct {
+	metrics            *metrics
+	logger             *mlog.Logger
+	HuaweiPushSettings HuaweiPushSettings
+	client             *http.Client
+	pushURL            string
+	token              *clientCredentialsToken
+	sendTimeout        time.Duration
+	retryTimeout       time.Duration
+}
+
+func NewHuaweiNotificationServer(settings HuaweiPushSettings, logger *mlog.Logger, metrics *metrics, sendTimeoutSecs int, retryTimeoutSecs int) *HuaweiNotificationServer {
+	return &HuaweiNotificationServer{
+		HuaweiPushSettings: settings,
+		metrics:            metrics,
+		logger:             logger,
+		sendTimeout:        time.Duration(sendTimeoutSecs) * time.Second,
+		retryTimeout:       time.Duration(retryTimeoutSecs) * time.Second,
+	}
+}
+
+func (me *HuaweiNotificationServer) Initialize() error {
+	me.logger.Info("Initializing huawei notification server", mlog.String("type", me.HuaweiPushSettings.Type))
+
+	if me.HuaweiPushSettings.HuaweiAppID == "" || me.HuaweiPushSettings.HuaweiClientSecret == "" {
+		return fmt.Errorf("huawei push notifications not configured: missing HuaweiAppID or HuaweiClientSecret for type=%v", me.HuaweiPushSettings.Type)
+	}
+
+	endpoint := HUAWEI_PUSH_ENDPOINT
+	if me.HuaweiPushSettings.HuaweiPushEndpoint != "" {
+		endpoint = strings.TrimSuffix(me.HuaweiPushSettings.HuaweiPushEndpoint, "/")
+		me.logger.Info("Sending huawei notifications to a custom endpoint", mlog.String("type", me.HuaweiPushSettings.Type), mlog.String("endpoint", endpoint))
+	}
+	me.pushURL = endpoint + "/v1/" + url.PathEscape(me.HuaweiPushSettings.HuaweiAppID) + "/messages:send"
+
+	tokenURL := HUAWEI_TOKEN_ENDPOINT
+	if me.HuaweiPushSettings.HuaweiTokenEndpoint != "" {
+		tokenURL = me.HuaweiPushSettings.HuaweiTokenEndpoint
+	}
+
+	me.client = &http.Client{}
+	me.token = newClientCredentialsToken(me.client, tokenURL, url.Values{
+		"client_id":     {me.HuaweiPushSettings.HuaweiAppID},
+		"client_secret": {me.HuaweiPushSettings.HuaweiClientSecret},
+	})
+	return nil
+}
+
+func (me *HuaweiNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
+	pushType := msg.Type
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard)
+	}
+
+	data, err := json.Marshal(notificationData(msg))
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+	body, err := json.Marshal(map[string]any{
+		"validate_only": false,
+		"message": huaweiMessage{
+			Data:    string(data),
+			Token:   []string{msg.DeviceId},
+			Android: huaweiAndroidConf{Urgency: "HIGH"},
+		},
+	})
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+
+	me.logger.Info(
+		"Sending huawei push notification",
+		mlog.String("device", me.HuaweiPushSettings.Type),
+		mlog.String("type", msg.Type),
+		mlog.String("ack_id", msg.AckId),
+	)
+	status, res, err := me.SendNotificationWithRetry(body)
+	if err != nil {
+		me.logger.Error(
+			"Failed to send huawei push",
+			mlog.String("sid", msg.ServerId),
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.Err(err),
+			mlog.String("type", me.HuaweiPushSettings.Type),
+		)
+		if errors.Is(err, errAccessToken) {
+			if me.metrics != nil {
+				me.metrics.incrementFailure(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard, tokenSourceError)
+			}
+			return NewErrorPushResponseWithReason(err.Error(), upstreamReason("HUAWEI", tokenSourceError), false)
+		}
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard, "RequestError")
+		}
+		return NewErrorPushResponseWithReason("unknown transport error", transportErrorReason(err), true)
+	}
+
+	if status == http.StatusOK && res.Code == HUAWEI_SUCCESS_CODE {
+		if me.metrics != nil {
+			if msg.AckId != "" {
+				me.metrics.incrementSuccessWithAck(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard)
+			} else {
+				me.metrics.incrementSuccess(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard)
+			}
+		}
+		return NewOkPushResponse()
+	}
+
+	reason := huaweiReason(status, res.Code)
+	// A single token was sent: a partial failure means it was rejected.
+	if res.Code == "80300007" || res.Code == "80100000" {
+		me.logger.Info(
+			"Failed to send huawei push sending remove code res",
+			mlog.String("code", res.Code),
+			mlog.String("msg", res.Msg),
+			mlog.String("requestId", res.RequestID),
+			mlog.String("type", me.HuaweiPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard, reason)
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("HUAWEI", reason))
+	}
+
+	me.logger.Error(
+		"Failed to send huawei push with res",
+		mlog.String("sid", msg.ServerId),
+		mlog.String("did", redactToken(msg.DeviceId)),
+		mlog.Int("status", status),
+		mlog.String("code", res.Code),
+		mlog.String("msg", res.Msg),
+		mlog.String("requestId", res.RequestID),
+		mlog.String("type", me.HuaweiPushSettings.Type),
+	)
+	if me.metrics != nil {
+		me.metrics.incrementFailure(PUSH_NOTIFY_HUAWEI, pushType, model.PushTransportStandard, reason)
+	}
+	return NewErrorPushResponseWithReason("unknown send response error", upstreamReason("HUAWEI", reason), isRetryableHuaweiResponse(status, res.Code))
+}
+
+func (me *HuaweiNotificationServer) SendNotificationWithRetry(body []byte) (int, *huaweiResponse, error) {
+	var status int
+	var res *huaweiResponse
+	err := retryWithBackoff(me.logger, me.metrics, PUSH_NOTIFY_HUAWEI, me.sendTimeout, me.retryTimeout, func(ctx context.Context) (bool, error) {
+		var err error
+		status, res, err = me.push(ctx, body)
+		if err == nil && (status == http.StatusUnauthorized || huaweiTokenRejectedCodes[res.Code]) {
+			// The access token was revoked or expired early, a new one
+			// is requested by the next attempt.
+			me.token.reset()
+			return true, nil
+		}
+		return !errors.Is(err, errAccessToken) && (err != nil || isRetryableHuaweiResponse(status, res.Code)), err
+	})
+	return status, res, err
+}
+
+// push posts a message to Push Kit and returns the status code and the
+// result of its response.
+func (me *HuaweiNotificationServer) push(ctx context.Context, body []byte) (int, *huaweiResponse, error) {
+	accessToken, err := me.token.get(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, me.pushURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := me.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	res := &huaweiResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(res); err != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, nil, fmt.Errorf("invalid push kit response: %w", err)
+	}
+	return resp.StatusCode, res, nil
+}
+
+// huaweiReason names the failure of a Push Kit response.
+func huaweiReason(status int, code string) string {
+	if reason, ok := huaweiErrorReasons[code]; ok {
+		return reason
+	}
+	switch status {
+	case http.StatusUnauthorized:
+		return "AUTH_ERROR"
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return "TOO_MANY_REQUESTS"
+	}
+	if code != "" {
+		return code
+	}
+	return httpStatusReason(status)
+}
+
+// isRetryableHuaweiResponse reports whether sending the same message again
+// later may succeed.
+func isRetryableHuaweiResponse(status int, code string) bool {
+	return code == "81000001" || isRetryableHTTPStatus(status)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestHuaweiNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	type reply struct {
+		status int
+		code   string
+	}
+
+	var mut sync.Mutex
+	tokensIssued := 0
+	var messages []huaweiMessage
+	replies := map[string][]reply{}
+	pushKit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path == "/token" {
+			require.NoError(t, r.ParseForm())
+			if r.PostForm.Get("client_id") != "123456" || r.PostForm.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]any{"error": 1101, "error_description": "invalid client"})
+				return
+			}
+			tokensIssued++
+			_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "expires_in": 3600, "token_type": "Bearer"})
+			return
+		}
+
+		assert.Equal(t, "/v1/123456/messages:send", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		var body struct {
+			Message huaweiMessage `json:"message"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		messages = append(messages, body.Message)
+
+		res := reply{http.StatusOK, HUAWEI_SUCCESS_CODE}
+		if scripted := replies[body.Message.Token[0]]; len(scripted) > 0 {
+			res = scripted[0]
+			replies[body.Message.Token[0]] = scripted[1:]
+		}
+		w.WriteHeader(res.status)
+		_ = json.NewEncoder(w).Encode(huaweiResponse{Code: res.code, Msg: "scripted", RequestID: "request"})
+	}))
+	defer pushKit.Close()
+
+	newServer := func(secret string) *HuaweiNotificationServer {
+		srv := NewHuaweiNotificationServer(HuaweiPushSettings{
+			Type:                "huawei",
+			HuaweiAppID:         "123456",
+			HuaweiClientSecret:  secret,
+			HuaweiPushEndpoint:  pushKit.URL,
+			HuaweiTokenEndpoint: pushKit.URL + "/token",
+		}, logger, nil, 10, 2)
+		require.NoError(t, srv.Initialize())
+		return srv
+	}
+	srv := newServer("secret")
+
+	t.Run("data messages are sent with the android data map", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage, Message: "hello", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+		srv.SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeClear})
+
+		mut.Lock()
+		defer mut.Unlock()
+		assert.Equal(t, 1, tokensIssued)
+		require.Len(t, messages, 2)
+		assert.Equal(t, []string{"device"}, messages[0].Token)
+		assert.Equal(t, "HIGH", messages[0].Android.Urgency)
+
+		var data map[string]string
+		require.NoError(t, json.Unmarshal([]byte(messages[0].Data), &data))
+		assert.Equal(t, "hello", data["message"])
+		assert.Equal(t, "channel", data["channel_id"])
+		assert.Equal(t, model.PushTypeMessage, data["type"])
+	})
+
+	t.Run("expired access tokens are renewed", func(t *testing.T) {
+		mut.Lock()
+		replies["renew"] = []reply{{http.StatusUnauthorized, "80200003"}}
+		mut.Unlock()
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "renew", Type: model.PushTypeMessage})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		assert.Equal(t, 2, tokensIssued)
+	})
+
+	for name, tc := range map[string]struct {
+		reply    reply
+		expected PushResponse
+	}{
+		"invalid token":     {reply{http.StatusOK, "80300007"}, NewRemovePushResponseWithReason("HUAWEI_INVALID_TOKEN")},
+		"illegal token":     {reply{http.StatusOK, "80100000"}, NewRemovePushResponseWithReason("HUAWEI_ILLEGAL_TOKEN")},
+		"invalid argument":  {reply{http.StatusBadRequest, "80100001"}, NewErrorPushResponseWithReason("unknown send response error", "HUAWEI_INVALID_ARGUMENT", false)},
+		"permission denied": {reply{http.StatusForbidden, "80300002"}, NewErrorPushResponseWithReason("unknown send response error", "HUAWEI_PERMISSION_DENIED", false)},
+		"internal error":    {reply{http.StatusInternalServerError, "81000001"}, NewErrorPushResponseWithReason("unknown send response error", "HUAWEI_INTERNAL", true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mut.Lock()
+			replies[name] = []reply{tc.reply, tc.reply, tc.reply}
+			mut.Unlock()
+
+			assert.Equal(t, tc.expected, srv.SendNotification(2, &model.PushNotification{DeviceId: name, Type: model.PushTypeMessage}))
+		})
+	}
+
+	t.Run("rejected client credentials", func(t *testing.T) {
+		resp := newServer("wrong").SendNotification(2, &model.PushNotification{DeviceId: "device", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "HUAWEI_TOKEN_SOURCE_ERROR", resp[PUSH_REASON])
+	})
+}
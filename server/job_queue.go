@@ -0,0 +1,164 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	JOB_STATUS_PENDING = "pending"
+	JOB_STATUS_DONE    = "done"
+)
+
+// JobStatus is the reply of the job lookup endpoint. Response is only set
+// once the notification has been handed to the push target.
+type JobStatus struct {
+	Id       string       `json:"id"`
+	Status   string       `json:"status"`
+	Response PushResponse `json:"response,omitempty"`
+}
+
+type pushJob struct {
+	id         string
+	target     NotificationServer
+	appVersion int
+	msg        *model.PushNotification
+	finishedAt time.Time
+	response   PushResponse
+}
+
+// jobQueue sends already validated notifications in the background so that
+// the caller does not have to wait for APNs or FCM to answer.
+type jobQueue struct {
+	logger    *mlog.Logger
+	queue     chan *pushJob
+	retention time.Duration
+
+	mut    sync.Mutex
+	jobs   map[string]*pushJob
+	closed bool
+
+	workers sync.WaitGroup
+	stop    chan struct{}
+}
+
+func newJobQueue(logger *mlog.Logger, size, workers int, retention time.Duration) *jobQueue {
+	q := &jobQueue{
+		logger:    logger,
+		queue:     make(chan *pushJob, size),
+		retention: retention,
+		jobs:      make(map[string]*pushJob),
+		stop:      make(chan struct{}),
+	}
+
+	for range workers {
+		q.workers.Go(q.work)
+	}
+	go q.prune()
+
+	return q
+}
+
+// enqueue schedules msg to be sent through target. It returns the id of the
+// new job, or false if the queue is full.
+func (q *jobQueue) enqueue(target NotificationServer, appVersion int, msg *model.PushNotification) (string, bool) {
+	job := &pushJob{
+		id:         model.NewId(),
+		target:     target,
+		appVersion: appVersion,
+		msg:        msg,
+	}
+
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.closed {
+		return "", false
+	}
+	select {
+	case q.queue <- job:
+		q.jobs[job.id] = job
+		return job.id, true
+	default:
+		return "", false
+	}
+}
+
+// status returns the current state of the job with the given id, or false if
+// it is unknown or has already been pruned.
+func (q *jobQueue) status(id string) (JobStatus, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return JobStatus{}, false
+	}
+
+	if job.response == nil {
+		return JobStatus{Id: id, Status: JOB_STATUS_PENDING}, true
+	}
+	return JobStatus{Id: id, Status: JOB_STATUS_DONE, Response: job.response}, true
+}
+
+func (q *jobQueue) work() {
+	for job := range q.queue {
+		resp := job.target.SendNotification(job.appVersion, job.msg)
+
+		q.mut.Lock()
+		job.response = resp
+		job.finishedAt = time.Now()
+		q.mut.Unlock()
+	}
+}
+
+// prune forgets about finished jobs once they are older than the retention
+// period.
+func (q *jobQueue) prune() {
+	ticker := time.NewTicker(max(q.retention/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+
+		q.mut.Lock()
+		for id, job := range q.jobs {
+			if job.response != nil && time.Since(job.finishedAt) > q.retention {
+				delete(q.jobs, id)
+			}
+		}
+		q.mut.Unlock()
+	}
+}
+
+// shutdown stops accepting jobs and waits for the queued ones to be sent,
+// until ctx expires.
+func (q *jobQueue) shutdown(ctx context.Context) {
+	q.mut.Lock()
+	q.closed = true
+	close(q.stop)
+	close(q.queue)
+	q.mut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.logger.Warn("Stopped waiting for queued push notifications", mlog.Int("pending", len(q.queue)))
+	}
+}
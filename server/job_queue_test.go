@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobQueue(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	target := &recordingNotificationServer{
+		responses: map[string]PushResponse{
+			"stale": NewRemovePushResponse(),
+		},
+	}
+
+	t.Run("jobs report their eventual response", func(t *testing.T) {
+		q := newJobQueue(logger, 10, 2, time.Minute)
+		defer q.shutdown(context.Background())
+
+		id, ok := q.enqueue(target, 1, &model.PushNotification{DeviceId: "stale"})
+		require.True(t, ok)
+
+		require.Eventually(t, func() bool {
+			status, found := q.status(id)
+			return found && status.Status == JOB_STATUS_DONE
+		}, 5*time.Second, 10*time.Millisecond)
+
+		status, _ := q.status(id)
+		assert.Equal(t, NewRemovePushResponse(), status.Response)
+
+		_, found := q.status("unknown")
+		assert.False(t, found)
+	})
+
+	t.Run("full queue rejects new jobs", func(t *testing.T) {
+		q := newJobQueue(logger, 0, 0, time.Minute)
+		defer q.shutdown(context.Background())
+
+		_, ok := q.enqueue(target, 1, &model.PushNotification{DeviceId: "dev"})
+		assert.False(t, ok)
+	})
+
+	t.Run("finished jobs are pruned after the retention period", func(t *testing.T) {
+		q := newJobQueue(logger, 10, 1, 50*time.Millisecond)
+		defer q.shutdown(context.Background())
+
+		id, ok := q.enqueue(target, 1, &model.PushNotification{DeviceId: "dev"})
+		require.True(t, ok)
+
+		require.Eventually(t, func() bool {
+			_, found := q.status(id)
+			return !found
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("shutdown drains queued jobs and refuses new ones", func(t *testing.T) {
+		q := newJobQueue(logger, 10, 1, time.Minute)
+
+		id, ok := q.enqueue(target, 1, &model.PushNotification{DeviceId: "dev"})
+		require.True(t, ok)
+		q.shutdown(context.Background())
+
+		status, found := q.status(id)
+		require.True(t, found)
+		assert.Equal(t, JOB_STATUS_DONE, status.Status)
+
+		_, ok = q.enqueue(target, 1, &model.PushNotification{DeviceId: "dev"})
+		assert.False(t, ok)
+	})
+}
@@ -18,6 +18,8 @@ const (
 	metricFailureWithReasonName        = "service_failure_with_reason_total"
 	metricRemovalName                  = "service_removal_total"
 	metricBadRequestName               = "service_bad_request_total"
+	metricAuthRejectedName             = "service_auth_rejected_total"
+	metricCredentialsExpiryName        = "service_credentials_expiry_seconds"
 	metricFCMResponseName              = "service_fcm_request_duration_seconds"
 	metricAPNSResponseName             = "service_apns_request_duration_seconds"
 	metricServiceResponseName          = "service_request_duration_seconds"
@@ -39,6 +41,8 @@ type metrics struct {
 	metricFailureWithReason        *prometheus.CounterVec
 	metricRemoval                  *prometheus.CounterVec
 	metricBadRequest               prometheus.Counter
+	metricAuthRejected             *prometheus.CounterVec
+	metricCredentialsExpiry        *prometheus.GaugeVec
 	metricAPNSResponse             prometheus.Histogram
 	metricFCMResponse              prometheus.Histogram
 	metricNotificationResponse     *prometheus.HistogramVec
@@ -86,6 +90,14 @@ func newMetrics() *metrics {
 			Name: metricBadRequestName,
 			Help: "Request to push proxy was a bad request",
 		}),
+		metricAuthRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metricAuthRejectedName,
+			Help: "Number of requests rejected because their signature could not be verified."},
+			[]string{"reason"}),
+		metricCredentialsExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricCredentialsExpiryName,
+			Help: "Seconds until the credentials of a push target expire, negative once expired."},
+			[]string{"platform", "type"}),
 		metricAPNSResponse: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: metricAPNSResponseName,
 			Help: "Request latency distribution",
@@ -113,6 +125,8 @@ func newMetrics() *metrics {
 		m.metricFailureWithReason,
 		m.metricRemoval,
 		m.metricBadRequest,
+		m.metricAuthRejected,
+		m.metricCredentialsExpiry,
 		m.metricAPNSResponse,
 		m.metricFCMResponse,
 		m.metricServiceResponse,
@@ -136,6 +150,8 @@ func (m *metrics) shutdown() {
 		m.metricFailureWithReason,
 		m.metricRemoval,
 		m.metricBadRequest,
+		m.metricAuthRejected,
+		m.metricCredentialsExpiry,
 		m.metricAPNSResponse,
 		m.metricFCMResponse,
 		m.metricServiceResponse,
@@ -191,6 +207,18 @@ func (m *metrics) incrementBadRequest() {
 	m.metricBadRequest.Inc()
 }
 
+func (m *metrics) incrementAuthRejected(reason string) {
+	m.metricAuthRejected.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) setCredentialsExpiry(platform, pushType string, seconds float64) {
+	m.metricCredentialsExpiry.WithLabelValues(platform, pushType).Set(seconds)
+}
+
+func (m *metrics) resetCredentialsExpiry() {
+	m.metricCredentialsExpiry.Reset()
+}
+
 func (m *metrics) observeAPNSResponse(dur float64) {
 	m.metricAPNSResponse.Observe(dur)
 }
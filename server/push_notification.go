@@ -3,6 +3,17 @@
 
 package server
 
+import (
+	"slices"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// PUSH_TYPE_CALL_DISMISS stops the ringing UI of a call on the devices it
+// was not answered on, when it was answered on another device or cancelled.
+// It references the channel and post of the call notification.
+const PUSH_TYPE_CALL_DISMISS = "call_dismiss"
+
 // redactToken returns the first 16 chars of a device token followed by an
 // ellipsis, for safe inclusion in logs.
 func redactToken(token string) string {
@@ -11,3 +22,19 @@ func redactToken(token string) string {
 	}
 	return token[:16] + "…"
 }
+
+// DEFAULT_SILENT_PUSH_TYPES are the notification types that are not shown
+// to the user, and are sent with low priority unless configured otherwise.
+// Apple and Google throttle apps sending such notifications with high
+// priority.
+var DEFAULT_SILENT_PUSH_TYPES = []string{model.PushTypeClear, model.PushTypeUpdateBadge}
+
+// isSilentPush reports whether msg is one of silentTypes, or of
+// DEFAULT_SILENT_PUSH_TYPES when they are unset. Id loaded notifications
+// are always shown.
+func isSilentPush(silentTypes []string, msg *model.PushNotification) bool {
+	if silentTypes == nil {
+		silentTypes = DEFAULT_SILENT_PUSH_TYPES
+	}
+	return !msg.IsIdLoaded && slices.Contains(silentTypes, msg.Type)
+}
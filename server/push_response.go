@@ -4,8 +4,14 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 const (
@@ -13,7 +19,25 @@ const (
 	PUSH_STATUS_OK        = "OK"
 	PUSH_STATUS_FAIL      = "FAIL"
 	PUSH_STATUS_REMOVE    = "REMOVE"
+	PUSH_STATUS_ACCEPTED  = "ACCEPTED"
 	PUSH_STATUS_ERROR_MSG = "error"
+	PUSH_JOB_ID           = "job_id"
+	PUSH_REASON           = "reason"
+	PUSH_RETRYABLE        = "retryable"
+)
+
+// Stable, machine-readable reasons reported along with FAIL and REMOVE
+// responses. Upstream reasons are reported with an APNS_ or FCM_ prefix,
+// e.g. APNS_TOO_MANY_REQUESTS or FCM_QUOTA_EXCEEDED.
+const (
+	REASON_BAD_REQUEST       = "BAD_REQUEST"
+	REASON_UNAUTHORIZED      = "UNAUTHORIZED"
+	REASON_UNKNOWN_PLATFORM  = "UNKNOWN_PLATFORM"
+	REASON_QUEUE_FULL        = "QUEUE_FULL"
+	REASON_JOB_NOT_FOUND     = "JOB_NOT_FOUND"
+	REASON_TRANSPORT_TIMEOUT = "TRANSPORT_TIMEOUT"
+	REASON_TRANSPORT_ERROR   = "TRANSPORT_ERROR"
+	REASON_BATCH_TIMEOUT     = "BATCH_TIMEOUT"
 )
 
 type PushResponse map[string]string
@@ -30,6 +54,24 @@ func NewRemovePushResponse() PushResponse {
 	return m
 }
 
+// NewRemovePushResponseWithReason is a REMOVE response that also tells
+// the caller why the device was rejected.
+func NewRemovePushResponseWithReason(reason string) PushResponse {
+	m := NewRemovePushResponse()
+	m[PUSH_REASON] = reason
+	m[PUSH_RETRYABLE] = strconv.FormatBool(false)
+	return m
+}
+
+// NewAcceptedPushResponse is returned when a notification has been queued
+// for asynchronous delivery as the job with the given id.
+func NewAcceptedPushResponse(jobId string) PushResponse {
+	m := make(map[string]string)
+	m[PUSH_STATUS] = PUSH_STATUS_ACCEPTED
+	m[PUSH_JOB_ID] = jobId
+	return m
+}
+
 func NewErrorPushResponse(message string) PushResponse {
 	m := make(map[string]string)
 	m[PUSH_STATUS] = PUSH_STATUS_FAIL
@@ -37,6 +79,97 @@ func NewErrorPushResponse(message string) PushResponse {
 	return m
 }
 
+// NewErrorPushResponseWithReason is a FAIL response carrying one of the
+// REASON_ codes, and whether the same notification may succeed if it is
+// sent again later.
+func NewErrorPushResponseWithReason(message, reason string, retryable bool) PushResponse {
+	m := NewErrorPushResponse(message)
+	m[PUSH_REASON] = reason
+	m[PUSH_RETRYABLE] = strconv.FormatBool(retryable)
+	return m
+}
+
+// upstreamReason turns an upstream error identifier, either CamelCase like
+// APNs' "TooManyRequests" or upper snake case like FCM's "QUOTA_EXCEEDED",
+// into a reason code with the given prefix.
+func upstreamReason(prefix, reason string) string {
+	if reason == "" {
+		reason = "UNKNOWN"
+	}
+	return prefix + "_" + screamingSnakeCase(reason)
+}
+
+// httpStatusReason turns an HTTP status code such as 410 into "GONE", for
+// upstream services that report failures with status codes only.
+func httpStatusReason(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return strconv.Itoa(status)
+	}
+	return strings.ToUpper(strings.ReplaceAll(text, " ", "_"))
+}
+
+// isRetryableHTTPStatus reports whether an upstream service replying with
+// status may accept the same notification later.
+func isRetryableHTTPStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// screamingSnakeCase turns a CamelCase identifier such as "TLSCertFile" into
+// "TLS_CERT_FILE". Identifiers already in upper snake case are unchanged.
+func screamingSnakeCase(s string) string {
+	var sb strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+	return sb.String()
+}
+
+// transportErrorReason classifies an error that prevented a request from
+// getting an answer from the upstream service.
+func transportErrorReason(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return REASON_TRANSPORT_TIMEOUT
+	}
+	return REASON_TRANSPORT_ERROR
+}
+
+// HTTPStatus returns the HTTP status code that matches the response: 4xx
+// when the request itself is at fault and 5xx when the upstream service
+// could not deliver it.
+func (pr PushResponse) HTTPStatus() int {
+	switch pr[PUSH_STATUS] {
+	case PUSH_STATUS_OK:
+		return http.StatusOK
+	case PUSH_STATUS_ACCEPTED:
+		return http.StatusAccepted
+	case PUSH_STATUS_REMOVE:
+		return http.StatusUnprocessableEntity
+	}
+
+	switch pr[PUSH_REASON] {
+	case REASON_BAD_REQUEST:
+		return http.StatusBadRequest
+	case REASON_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case REASON_UNKNOWN_PLATFORM, REASON_JOB_NOT_FOUND:
+		return http.StatusNotFound
+	case REASON_QUEUE_FULL:
+		return http.StatusServiceUnavailable
+	case REASON_TRANSPORT_TIMEOUT:
+		return http.StatusGatewayTimeout
+	}
+
+	if pr[PUSH_RETRYABLE] == "true" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
 func PushResponseFromJson(data io.Reader) PushResponse {
 	decoder := json.NewDecoder(data)
 
@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	apns "github.com/sideshow/apns2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamReason(t *testing.T) {
+	for _, tc := range []struct {
+		reason string
+		want   string
+	}{
+		{apns.ReasonTooManyRequests, "APNS_TOO_MANY_REQUESTS"},
+		{apns.ReasonBadCollapseID, "APNS_BAD_COLLAPSE_ID"},
+		{apns.ReasonInvalidProviderToken, "APNS_INVALID_PROVIDER_TOKEN"},
+		{quotaExceeded, "APNS_QUOTA_EXCEEDED"},
+		{"", "APNS_UNKNOWN"},
+	} {
+		t.Run(tc.reason, func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamReason("APNS", tc.reason))
+		})
+	}
+}
+
+func TestPushResponseWithReason(t *testing.T) {
+	resp := NewErrorPushResponseWithReason("slow down", "APNS_TOO_MANY_REQUESTS", true)
+	assert.Equal(t, PushResponse{
+		PUSH_STATUS:           PUSH_STATUS_FAIL,
+		PUSH_STATUS_ERROR_MSG: "slow down",
+		PUSH_REASON:           "APNS_TOO_MANY_REQUESTS",
+		PUSH_RETRYABLE:        "true",
+	}, resp)
+
+	resp = NewRemovePushResponseWithReason("FCM_UNREGISTERED")
+	assert.Equal(t, PushResponse{
+		PUSH_STATUS:    PUSH_STATUS_REMOVE,
+		PUSH_REASON:    "FCM_UNREGISTERED",
+		PUSH_RETRYABLE: "false",
+	}, resp)
+}
+
+func TestTransportErrorReason(t *testing.T) {
+	assert.Equal(t, REASON_TRANSPORT_TIMEOUT, transportErrorReason(fmt.Errorf("post: %w", context.DeadlineExceeded)))
+	assert.Equal(t, REASON_TRANSPORT_ERROR, transportErrorReason(errors.New("connection refused")))
+}
+
+func TestPushResponseHTTPStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		resp PushResponse
+		want int
+	}{
+		{"ok", NewOkPushResponse(), http.StatusOK},
+		{"accepted", NewAcceptedPushResponse("id"), http.StatusAccepted},
+		{"remove", NewRemovePushResponseWithReason("APNS_BAD_DEVICE_TOKEN"), http.StatusUnprocessableEntity},
+		{"bad request", NewErrorPushResponseWithReason("", REASON_BAD_REQUEST, false), http.StatusBadRequest},
+		{"unknown platform", NewErrorPushResponseWithReason("", REASON_UNKNOWN_PLATFORM, false), http.StatusNotFound},
+		{"queue full", NewErrorPushResponseWithReason("", REASON_QUEUE_FULL, true), http.StatusServiceUnavailable},
+		{"timeout", NewErrorPushResponseWithReason("", REASON_TRANSPORT_TIMEOUT, true), http.StatusGatewayTimeout},
+		{"retryable upstream error", NewErrorPushResponseWithReason("", "APNS_TOO_MANY_REQUESTS", true), http.StatusServiceUnavailable},
+		{"permanent upstream error", NewErrorPushResponseWithReason("", "FCM_THIRD_PARTY_AUTH_ERROR", false), http.StatusBadGateway},
+		{"error without reason", NewErrorPushResponse("unknown"), http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.resp.HTTPStatus())
+		})
+	}
+}
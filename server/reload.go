@@ -0,0 +1,239 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// pushTargetSettings are the settings a push target was initialized with.
+// On reload, a target is only initialized again when they change, or when
+// its credential files were modified since.
+type pushTargetSettings struct {
+	settings        any
+	sendTimeoutSec  int
+	retryTimeoutSec int
+	// modTimes are the modification times of the credential files.
+	modTimes map[string]time.Time
+}
+
+// buildPushTargets initializes a push target for every entry of cfg. Targets
+// in current whose settings did not change are reused as they are, and are
+// kept when their new settings fail to initialize.
+func (s *Server) buildPushTargets(cfg *ConfigPushProxy, current map[string]NotificationServer, currentSettings map[string]pushTargetSettings) (map[string]NotificationServer, map[string]pushTargetSettings) {
+	targets := make(map[string]NotificationServer)
+	targetSettings := make(map[string]pushTargetSettings)
+
+	add := func(pushType, platform string, settings any, files []string, newServer func() NotificationServer) {
+		ts := pushTargetSettings{
+			settings:        settings,
+			sendTimeoutSec:  cfg.SendTimeoutSec,
+			retryTimeoutSec: cfg.RetryTimeoutSec,
+			modTimes:        credentialModTimes(files),
+		}
+
+		existing, exists := current[pushType]
+		if exists && reflect.DeepEqual(currentSettings[pushType], ts) {
+			targets[pushType] = existing
+			targetSettings[pushType] = currentSettings[pushType]
+			return
+		}
+
+		server := newServer()
+		err := server.Initialize()
+		if err != nil && exists {
+			s.logger.Error("Failed to initialize client, keeping the previous one", mlog.String("type", pushType), mlog.Err(err))
+			targets[pushType] = existing
+			targetSettings[pushType] = currentSettings[pushType]
+			return
+		}
+
+		s.health.initialized(pushType, platform, server, err)
+		if err != nil {
+			s.logger.Error("Failed to initialize client", mlog.Err(err))
+			return
+		}
+		if current != nil {
+			s.logger.Info("Initialized push target with new settings", mlog.String("type", pushType))
+		}
+		targets[pushType] = s.health.track(pushType, platform, server)
+		targetSettings[pushType] = ts
+	}
+
+	for _, settings := range cfg.ApplePushSettings {
+		var files []string
+		for _, set := range settings.credentialSets() {
+			files = append(files, set.AppleAuthKeyFile, set.ApplePushCertPrivate)
+		}
+		add(settings.Type, model.PushNotifyApple, settings, files, func() NotificationServer {
+			return s.newAppleTarget(settings, cfg)
+		})
+	}
+
+	for _, settings := range cfg.AndroidPushSettings {
+		var files []string
+		for _, set := range settings.credentialSets() {
+			files = append(files, set.ServiceFileLocation)
+		}
+		add(settings.Type, model.PushNotifyAndroid, settings, files, func() NotificationServer {
+			return s.newAndroidTarget(settings, cfg)
+		})
+	}
+
+	for _, settings := range cfg.HuaweiPushSettings {
+		add(settings.Type, PUSH_NOTIFY_HUAWEI, settings, nil, func() NotificationServer {
+			return NewHuaweiNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+		})
+	}
+
+	for _, settings := range cfg.WebPushSettings {
+		add(settings.Type, PUSH_NOTIFY_WEB, settings, nil, func() NotificationServer {
+			return NewWebPushNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+		})
+	}
+
+	for _, settings := range cfg.WNSPushSettings {
+		add(settings.Type, PUSH_NOTIFY_WNS, settings, nil, func() NotificationServer {
+			return NewWNSNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+		})
+	}
+
+	for _, settings := range cfg.WebhookPushSettings {
+		add(settings.Type, PUSH_NOTIFY_WEBHOOK, settings, nil, func() NotificationServer {
+			return NewWebhookNotificationServer(settings, s.logger, s.metrics, cfg.SendTimeoutSec, cfg.RetryTimeoutSec)
+		})
+	}
+
+	for _, settings := range cfg.DevPushSettings {
+		add(settings.Type, settings.Platform, settings, nil, func() NotificationServer {
+			return NewDevNotificationServer(settings, s.logger)
+		})
+	}
+
+	return targets, targetSettings
+}
+
+// SetConfigFile records the file the config was loaded from, so that it can
+// be read again by ReloadConfig.
+func (s *Server) SetConfigFile(fileName string) {
+	s.configFile = fileName
+}
+
+// ReloadConfig reads the config file again and applies the settings that can
+// change at runtime: push targets, throttling and request signing. Only the
+// push targets whose settings changed are initialized again, and requests
+// already being handled finish with the targets they started with.
+func (s *Server) ReloadConfig() error {
+	s.reloadMut.Lock()
+	defer s.reloadMut.Unlock()
+
+	if s.configFile == "" {
+		return errors.New("no config file to reload")
+	}
+
+	cfg, err := LoadConfig(s.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	s.mut.RLock()
+	previous := s.cfg
+	current := s.pushTargets
+	currentSettings := s.targetSettings
+	s.mut.RUnlock()
+
+	s.warnStaticSettingsChanged(previous, cfg)
+
+	targets, targetSettings := s.buildPushTargets(cfg, current, currentSettings)
+	throttledHandler := s.newThrottle(cfg).Throttle(s.router)
+
+	s.mut.Lock()
+	s.cfg = cfg
+	s.pushTargets = targets
+	s.targetSettings = targetSettings
+	s.throttled = throttledHandler
+	s.mut.Unlock()
+
+	s.health.retain(cfg.pushTypes())
+	s.checkCredentialsExpiry()
+
+	s.logger.Info("Reloaded config", mlog.String("file", s.configFile), mlog.Int("targets", len(targets)))
+	return nil
+}
+
+// warnStaticSettingsChanged logs the settings that changed but only take
+// effect after a restart.
+func (s *Server) warnStaticSettingsChanged(previous, cfg *ConfigPushProxy) {
+	static := []string{
+		"ListenAddress",
+		"TLSCertFile",
+		"TLSKeyFile",
+		"TLSClientCAFile",
+		"EnableMetrics",
+		"EnableAdminEndpoint",
+		"EnableConsoleLog",
+		"EnableFileLog",
+		"LogFileLocation",
+		"LogFormat",
+		"AsyncQueueSize",
+		"AsyncWorkers",
+		"AsyncJobRetentionSec",
+	}
+
+	prev := reflect.ValueOf(previous).Elem()
+	next := reflect.ValueOf(cfg).Elem()
+	for _, name := range static {
+		if !reflect.DeepEqual(prev.FieldByName(name).Interface(), next.FieldByName(name).Interface()) {
+			s.logger.Warn("Config setting changed but requires a restart to take effect", mlog.String("setting", name))
+		}
+	}
+}
+
+// handleReload reloads the config on behalf of a process running on the same
+// host.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		s.logger.Error("Rejected config reload from remote address", mlog.String("ip", s.getIpAddress(r)))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Every local process can reach the loopback interface, including a
+	// reverse proxy forwarding remote requests, so the token is required too.
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	adminToken := s.config().AdminToken
+	if !ok || adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		s.logger.Error("Rejected config reload without a valid admin token", mlog.String("ip", s.getIpAddress(r)))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.ReloadConfig(); err != nil {
+		rMsg := fmt.Sprintf("Failed to reload config: %v", err)
+		s.logger.Error(rMsg)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		if err2 := json.NewEncoder(w).Encode(NewErrorPushResponse(rMsg)); err2 != nil {
+			s.logger.Error("Failed to write response", mlog.Err(err2))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(NewOkPushResponse()); err != nil {
+		s.logger.Error("Failed to write response", mlog.Err(err))
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestReloadConfig(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	serviceFile := filepath.Join(dir, "service-account.json")
+	f, err := os.Create(serviceFile)
+	require.NoError(t, err)
+	require.NoError(t, json.NewEncoder(f).Encode(serviceAccount{Type: "service_account", ProjectID: "sample"}))
+	require.NoError(t, f.Close())
+
+	configFile := filepath.Join(dir, "config.json")
+	writeConfig := func(cfg ConfigPushProxy) {
+		buf, err := json.Marshal(cfg)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(configFile, buf, 0600))
+	}
+
+	base := ConfigPushProxy{
+		ThrottlePerSec:          300,
+		ThrottleMemoryStoreSize: 50000,
+		AndroidPushSettings: []AndroidPushSettings{
+			{Type: "android", ServiceFileLocation: serviceFile},
+		},
+	}
+	writeConfig(base)
+
+	cfg, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	srv := New(cfg, logger)
+	srv.SetConfigFile(configFile)
+	srv.router = mux.NewRouter()
+	srv.pushTargets, srv.targetSettings = srv.buildPushTargets(cfg, nil, nil)
+
+	android, ok := srv.pushTarget("android")
+	require.True(t, ok)
+
+	t.Run("unchanged targets are reused and new ones added", func(t *testing.T) {
+		next := base
+		next.ThrottlePerSec = 10
+		next.AndroidPushSettings = append(next.AndroidPushSettings, AndroidPushSettings{Type: "android_rn", ServiceFileLocation: serviceFile})
+		writeConfig(next)
+		require.NoError(t, srv.ReloadConfig())
+
+		reloaded, ok := srv.pushTarget("android")
+		require.True(t, ok)
+		assert.Same(t, android, reloaded)
+		_, ok = srv.pushTarget("android_rn")
+		assert.True(t, ok)
+		assert.Equal(t, 10, srv.config().ThrottlePerSec)
+	})
+
+	t.Run("targets failing with their new settings keep the previous client", func(t *testing.T) {
+		next := base
+		next.AndroidPushSettings = []AndroidPushSettings{
+			{Type: "android", ServiceFileLocation: filepath.Join(dir, "missing.json")},
+		}
+		writeConfig(next)
+		require.NoError(t, srv.ReloadConfig())
+
+		reloaded, ok := srv.pushTarget("android")
+		require.True(t, ok)
+		assert.Same(t, android, reloaded)
+	})
+
+	t.Run("removed targets are dropped", func(t *testing.T) {
+		writeConfig(base)
+		require.NoError(t, srv.ReloadConfig())
+
+		_, ok := srv.pushTarget("android_rn")
+		assert.False(t, ok)
+		report, _ := srv.health.report()
+		require.Len(t, report.Targets, 1)
+		assert.Equal(t, "android", report.Targets[0].Type)
+	})
+
+	t.Run("invalid config is not applied", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(configFile, []byte("{junk"), 0600))
+		require.Error(t, srv.ReloadConfig())
+
+		_, ok := srv.pushTarget("android")
+		assert.True(t, ok)
+	})
+
+	admin := base
+	admin.EnableAdminEndpoint = true
+	admin.AdminToken = "admin-token"
+
+	t.Run("admin endpoint only accepts local requests", func(t *testing.T) {
+		writeConfig(admin)
+		require.NoError(t, srv.ReloadConfig())
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		req.RemoteAddr = "10.0.0.1:1234"
+		res := httptest.NewRecorder()
+		srv.handleReload(res, req)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+
+		req.RemoteAddr = "127.0.0.1:1234"
+		res = httptest.NewRecorder()
+		srv.handleReload(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+
+	t.Run("admin endpoint requires the admin token", func(t *testing.T) {
+		writeConfig(admin)
+		require.NoError(t, srv.ReloadConfig())
+
+		for _, header := range []string{"", "admin-token", "Bearer wrong-token", "Bearer "} {
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("Authorization", header)
+			res := httptest.NewRecorder()
+			srv.handleReload(res, req)
+			assert.Equal(t, http.StatusUnauthorized, res.Code, header)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set("Authorization", "Bearer admin-token")
+		res := httptest.NewRecorder()
+		srv.handleReload(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+
+	t.Run("admin endpoint cannot be enabled without a token", func(t *testing.T) {
+		cfg := base
+		cfg.EnableAdminEndpoint = true
+		writeConfig(cfg)
+		assert.Error(t, srv.ReloadConfig())
+	})
+}
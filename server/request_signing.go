@@ -0,0 +1,145 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	HEADER_SERVER_ID = "X-Push-Server-Id"
+	HEADER_TIMESTAMP = "X-Push-Timestamp"
+	HEADER_SIGNATURE = "X-Push-Signature"
+
+	// MAX_SIGNED_BODY_BYTES bounds how much of a request is buffered to
+	// verify its signature.
+	MAX_SIGNED_BODY_BYTES = 10 << 20
+
+	// A server can have at most two active secrets, so that a new one can be
+	// rolled out before the old one is removed.
+	MAX_SIGNING_SECRETS = 2
+)
+
+const signedServerIdContextKey contextKey = "signed_server_id"
+
+// Reasons a signed request is rejected, used as metric labels.
+const (
+	authMissingHeaders   = "missing_headers"
+	authUnknownServer    = "unknown_server"
+	authStaleTimestamp   = "stale_timestamp"
+	authBadSignature     = "bad_signature"
+	authServerIdMismatch = "server_id_mismatch"
+)
+
+// signRequest computes the signature a Mattermost server sends in the
+// X-Push-Signature header: the hex encoded HMAC-SHA256 of the timestamp, the
+// method, the path and query of the request and its body, separated by new
+// lines. Covering the method and path keeps a signed request from being
+// replayed against another endpoint.
+func signRequest(secret, timestamp, method, requestURI string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + requestURI + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireSignature only lets requests through if they are signed with one of
+// the secrets configured for the server named in the X-Push-Server-Id header.
+// When no secrets are configured, every request is let through.
+func (s *Server) requireSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.config()
+		if len(cfg.RequestSigningSecrets) == 0 {
+			next(w, r)
+			return
+		}
+
+		serverId := r.Header.Get(HEADER_SERVER_ID)
+		timestamp := r.Header.Get(HEADER_TIMESTAMP)
+		signature := r.Header.Get(HEADER_SIGNATURE)
+		if serverId == "" || timestamp == "" || signature == "" {
+			s.rejectRequest(w, r, serverId, authMissingHeaders)
+			return
+		}
+
+		secrets, ok := cfg.RequestSigningSecrets[serverId]
+		if !ok {
+			s.rejectRequest(w, r, serverId, authUnknownServer)
+			return
+		}
+
+		sentAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sentAt, 0)).Abs() > time.Duration(cfg.RequestSigningMaxSkewSec)*time.Second {
+			s.rejectRequest(w, r, serverId, authStaleTimestamp)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_SIGNED_BODY_BYTES))
+		if err != nil {
+			rMsg := fmt.Sprintf("Failed to read request body: %v", err)
+			s.logger.Error(rMsg)
+			s.writeResponse(w, r, NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false))
+			if s.metrics != nil {
+				s.metrics.incrementBadRequest()
+			}
+			return
+		}
+
+		verified := false
+		for _, secret := range secrets {
+			if hmac.Equal([]byte(signRequest(secret, timestamp, r.Method, r.URL.RequestURI(), body)), []byte(signature)) {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			s.rejectRequest(w, r, serverId, authBadSignature)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r.WithContext(context.WithValue(r.Context(), signedServerIdContextKey, serverId)))
+	}
+}
+
+// checkSignedServerId makes sure a notification claims to come from the
+// server that signed the request carrying it. It returns an error response
+// otherwise.
+func (s *Server) checkSignedServerId(r *http.Request, serverId string) PushResponse {
+	signedServerId, ok := r.Context().Value(signedServerIdContextKey).(string)
+	if !ok || signedServerId == serverId {
+		return nil
+	}
+
+	s.logAuthRejection(r, signedServerId, authServerIdMismatch)
+	return NewErrorPushResponseWithReason(fmt.Sprintf("Failed because serverId=%v does not match the signing server", serverId), REASON_UNAUTHORIZED, false)
+}
+
+func (s *Server) rejectRequest(w http.ResponseWriter, r *http.Request, serverId string, reason string) {
+	s.logAuthRejection(r, serverId, reason)
+	s.writeResponse(w, r, NewErrorPushResponseWithReason("Failed because the request signature could not be verified", REASON_UNAUTHORIZED, false))
+}
+
+func (s *Server) logAuthRejection(r *http.Request, serverId string, reason string) {
+	s.logger.Error("Rejected unauthenticated request",
+		mlog.String("path", r.URL.Path),
+		mlog.String("ip", s.getIpAddress(r)),
+		mlog.String("sid", serverId),
+		mlog.String("reason", reason),
+	)
+	if s.metrics != nil {
+		s.metrics.incrementAuthRejected(reason)
+	}
+}
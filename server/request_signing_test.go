@@ -0,0 +1,103 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireSignature(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	m := newMetrics()
+	defer m.shutdown()
+
+	srv := New(&ConfigPushProxy{
+		RequestSigningSecrets: map[string][]string{
+			"server1": {"old-secret", "new-secret"},
+		},
+		RequestSigningMaxSkewSec: 60,
+	}, logger)
+	srv.metrics = m
+	srv.pushTargets[model.PushNotifyAndroid] = &recordingNotificationServer{}
+	handler := statusCodesMiddleware(srv.requireSignature(srv.handleSendNotification))
+
+	sendSignedFor := func(signedURI, serverId, secret string, sentAt time.Time, msg model.PushNotification) *httptest.ResponseRecorder {
+		body, err := json.Marshal(msg)
+		require.NoError(t, err)
+		timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/send_push?async=false", bytes.NewReader(body))
+		req.Header.Set(HEADER_SERVER_ID, serverId)
+		req.Header.Set(HEADER_TIMESTAMP, timestamp)
+		req.Header.Set(HEADER_SIGNATURE, signRequest(secret, timestamp, http.MethodPost, signedURI, body))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	send := func(serverId, secret string, sentAt time.Time, msg model.PushNotification) *httptest.ResponseRecorder {
+		return sendSignedFor("/api/v2/send_push?async=false", serverId, secret, sentAt, msg)
+	}
+
+	msg := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid}
+
+	t.Run("both active secrets are accepted", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("server1", "old-secret", time.Now(), msg).Code)
+		assert.Equal(t, http.StatusOK, send("server1", "new-secret", time.Now(), msg).Code)
+	})
+
+	t.Run("rejected requests", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			serverId string
+			secret   string
+			sentAt   time.Time
+			msg      model.PushNotification
+			reason   string
+		}{
+			{"wrong secret", "server1", "guess", time.Now(), msg, authBadSignature},
+			{"unknown server", "server2", "old-secret", time.Now(), msg, authUnknownServer},
+			{"stale timestamp", "server1", "new-secret", time.Now().Add(-time.Hour), msg, authStaleTimestamp},
+			{"server id mismatch", "server1", "new-secret", time.Now(), model.PushNotification{ServerId: "server2", DeviceId: "dev1", Platform: model.PushNotifyAndroid}, authServerIdMismatch},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				res := send(tc.serverId, tc.secret, tc.sentAt, tc.msg)
+				assert.Equal(t, http.StatusUnauthorized, res.Code)
+				assert.Equal(t, REASON_UNAUTHORIZED, PushResponseFromJson(res.Body)[PUSH_REASON])
+				assert.Equal(t, float64(1), testutil.ToFloat64(m.metricAuthRejected.WithLabelValues(tc.reason)))
+			})
+		}
+	})
+
+	t.Run("signatures are bound to the method and path", func(t *testing.T) {
+		rejected := testutil.ToFloat64(m.metricAuthRejected.WithLabelValues(authBadSignature))
+		for _, signedURI := range []string{"/api/v2/ack", "/api/v2/send_push?async=true"} {
+			res := sendSignedFor(signedURI, "server1", "new-secret", time.Now(), msg)
+			assert.Equal(t, http.StatusUnauthorized, res.Code, signedURI)
+		}
+		assert.Equal(t, rejected+2, testutil.ToFloat64(m.metricAuthRejected.WithLabelValues(authBadSignature)))
+	})
+
+	t.Run("unsigned request is rejected", func(t *testing.T) {
+		body, err := json.Marshal(msg)
+		require.NoError(t, err)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/api/v2/send_push", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.metricAuthRejected.WithLabelValues(authMissingHeaders)))
+	})
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// retryWithBackoff makes up to MAX_RETRIES attempts at sending a push,
+// waiting one second before the first retry and twice as long before each of
+// the next ones. Every attempt is bounded by retryTimeout, and all of them
+// together by sendTimeout. attempt reports whether its failure is worth
+// retrying. The error of the last attempt is returned, or the context error
+// when sendTimeout runs out before a retry.
+func retryWithBackoff(logger *mlog.Logger, metrics *metrics, platform string, sendTimeout, retryTimeout time.Duration, attempt func(ctx context.Context) (retry bool, err error)) error {
+	var err error
+	waitTime := time.Second
+
+	// Keep a general context to make sure the whole retry
+	// doesn't take longer than the timeout.
+	generalContext, cancelGeneralContext := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancelGeneralContext()
+
+	for retries := range MAX_RETRIES {
+		start := time.Now()
+
+		retryContext, cancelRetryContext := context.WithTimeout(generalContext, retryTimeout)
+		var retry bool
+		retry, err = attempt(retryContext)
+		cancelRetryContext()
+		if metrics != nil {
+			metrics.observerNotificationResponse(platform, time.Since(start).Seconds())
+		}
+
+		if !retry {
+			break
+		}
+
+		logger.Error(
+			"Failed to send push",
+			mlog.String("platform", platform),
+			mlog.Int("retry", retries),
+			mlog.Err(err),
+		)
+
+		if retries == MAX_RETRIES-1 {
+			logger.Error("Max retries reached")
+			break
+		}
+
+		select {
+		case <-generalContext.Done():
+		case <-time.After(waitTime):
+		}
+
+		if generalContext.Err() != nil {
+			logger.Info(
+				"Not retrying because context error",
+				mlog.Int("retry", retries),
+				mlog.Err(generalContext.Err()),
+			)
+			err = generalContext.Err()
+			break
+		}
+
+		waitTime *= 2
+	}
+
+	return err
+}
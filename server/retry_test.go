@@ -0,0 +1,57 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	errSend := errors.New("send failed")
+
+	t.Run("failures not worth retrying are returned", func(t *testing.T) {
+		attempts := 0
+		err := retryWithBackoff(logger, nil, "test", time.Minute, time.Second, func(ctx context.Context) (bool, error) {
+			attempts++
+			_, hasDeadline := ctx.Deadline()
+			assert.True(t, hasDeadline)
+			return false, errSend
+		})
+		assert.Equal(t, errSend, err)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("retries are made until one succeeds", func(t *testing.T) {
+		attempts := 0
+		err := retryWithBackoff(logger, nil, "test", time.Minute, time.Second, func(context.Context) (bool, error) {
+			attempts++
+			if attempts == 1 {
+				return true, errSend
+			}
+			return false, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("retries stop when the send timeout runs out", func(t *testing.T) {
+		attempts := 0
+		err := retryWithBackoff(logger, nil, "test", 100*time.Millisecond, time.Second, func(context.Context) (bool, error) {
+			attempts++
+			return true, errSend
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, 1, attempts)
+	})
+}
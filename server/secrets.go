@@ -0,0 +1,280 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefixes of the settings values that refer to a secret instead of holding
+// it: "file:/run/secrets/x" reads a file, "env:VAR" an environment variable
+// and "secret:name" an entry of the encrypted SecretsFile.
+const (
+	SECRET_REF_FILE   = "file:"
+	SECRET_REF_ENV    = "env:"
+	SECRET_REF_SECRET = "secret:"
+
+	// SECRETS_KEY_ENV holds the base64 encoded 256-bit key SecretsFile is
+	// encrypted with.
+	SECRETS_KEY_ENV = "PUSH_PROXY_SECRETS_KEY"
+)
+
+// secretStore holds the decrypted entries of the SecretsFile.
+type secretStore map[string]string
+
+// loadSecretStore decrypts fileName with the key found in the SECRETS_KEY_ENV
+// environment variable.
+func loadSecretStore(fileName string) (secretStore, error) {
+	key, err := secretsKey()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secrets file: %w", err)
+	}
+
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("failed to decrypt secrets file: file is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secrets file: %w", err)
+	}
+
+	var store secretStore
+	if err := json.Unmarshal(plain, &store); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %w", err)
+	}
+	return store, nil
+}
+
+// EncryptSecrets seals a JSON object mapping secret names to values into the
+// format expected for SecretsFile, using the key found in the
+// SECRETS_KEY_ENV environment variable.
+func EncryptSecrets(plain []byte) ([]byte, error) {
+	var store secretStore
+	if err := json.Unmarshal(plain, &store); err != nil {
+		return nil, fmt.Errorf("secrets must be a JSON object of strings: %w", err)
+	}
+
+	key, err := secretsKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+func secretsKey() ([]byte, error) {
+	encoded := os.Getenv(SECRETS_KEY_ENV)
+	if encoded == "" {
+		return nil, fmt.Errorf("%v must be set to unlock the secrets file", SECRETS_KEY_ENV)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%v must be a base64 encoded 32 byte key", SECRETS_KEY_ENV)
+	}
+	return key, nil
+}
+
+func newSecretsAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// resolveSecret returns the value a setting refers to, or the setting itself
+// when it is not a secret reference.
+func resolveSecret(value string, store secretStore) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SECRET_REF_FILE):
+		buf, err := os.ReadFile(strings.TrimPrefix(value, SECRET_REF_FILE))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case strings.HasPrefix(value, SECRET_REF_ENV):
+		name := strings.TrimPrefix(value, SECRET_REF_ENV)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %v is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, SECRET_REF_SECRET):
+		name := strings.TrimPrefix(value, SECRET_REF_SECRET)
+		if store == nil {
+			return "", fmt.Errorf("secret %v is used but SecretsFile is not set", name)
+		}
+		secret, ok := store[name]
+		if !ok {
+			return "", fmt.Errorf("secret %v is not in SecretsFile", name)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// resolveSecretFile resolves a setting naming a credentials file. "file:"
+// references are plain paths. The content of "env:" and "secret:" references
+// is only kept in memory, as the second return value, for readSecretFile to
+// hand it to the targets without writing it to disk.
+func resolveSecretFile(value string, store secretStore) (string, []byte, error) {
+	if strings.HasPrefix(value, SECRET_REF_FILE) {
+		return strings.TrimPrefix(value, SECRET_REF_FILE), nil, nil
+	}
+	if !strings.HasPrefix(value, SECRET_REF_ENV) && !strings.HasPrefix(value, SECRET_REF_SECRET) {
+		return value, nil, nil
+	}
+
+	content, err := resolveSecret(value, store)
+	if err != nil {
+		return "", nil, err
+	}
+	return value, []byte(content), nil
+}
+
+// readSecretFile returns the content of a credentials file setting: the
+// secret it was resolved to, or else the content of the file it names.
+func readSecretFile(fileName string, resolved []byte) ([]byte, error) {
+	if resolved != nil {
+		return resolved, nil
+	}
+	return os.ReadFile(fileName)
+}
+
+// resolveSecrets replaces the secret references of cfg with the secrets they
+// refer to.
+func resolveSecrets(cfg *ConfigPushProxy) error {
+	var store secretStore
+	if cfg.SecretsFile != "" {
+		var err error
+		if store, err = loadSecretStore(cfg.SecretsFile); err != nil {
+			return err
+		}
+	}
+
+	resolve := func(setting string, value *string, resolver func(string, secretStore) (string, error)) error {
+		resolved, err := resolver(*value, store)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %v: %w", setting, err)
+		}
+		*value = resolved
+		return nil
+	}
+
+	resolveFile := func(setting string, value *string, content *[]byte) error {
+		resolved, resolvedContent, err := resolveSecretFile(*value, store)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %v: %w", setting, err)
+		}
+		*value = resolved
+		*content = resolvedContent
+		return nil
+	}
+
+	var resolveApple func(prefix string, settings *ApplePushSettings) error
+	resolveApple = func(prefix string, settings *ApplePushSettings) error {
+		if err := resolve(prefix+"ApplePushCertPassword", &settings.ApplePushCertPassword, resolveSecret); err != nil {
+			return err
+		}
+		if err := resolveFile(prefix+"ApplePushCertPrivate", &settings.ApplePushCertPrivate, &settings.pushCert); err != nil {
+			return err
+		}
+		if err := resolveFile(prefix+"AppleAuthKeyFile", &settings.AppleAuthKeyFile, &settings.authKey); err != nil {
+			return err
+		}
+		for j := range settings.Fallbacks {
+			if err := resolveApple(fmt.Sprintf("%vFallbacks[%d].", prefix, j), &settings.Fallbacks[j]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var resolveAndroid func(prefix string, settings *AndroidPushSettings) error
+	resolveAndroid = func(prefix string, settings *AndroidPushSettings) error {
+		if err := resolveFile(prefix+"ServiceFileLocation", &settings.ServiceFileLocation, &settings.serviceFile); err != nil {
+			return err
+		}
+		for j := range settings.Fallbacks {
+			if err := resolveAndroid(fmt.Sprintf("%vFallbacks[%d].", prefix, j), &settings.Fallbacks[j]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := range cfg.ApplePushSettings {
+		if err := resolveApple(fmt.Sprintf("ApplePushSettings[%d].", i), &cfg.ApplePushSettings[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.AndroidPushSettings {
+		if err := resolveAndroid(fmt.Sprintf("AndroidPushSettings[%d].", i), &cfg.AndroidPushSettings[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.HuaweiPushSettings {
+		if err := resolve(fmt.Sprintf("HuaweiPushSettings[%d].HuaweiClientSecret", i), &cfg.HuaweiPushSettings[i].HuaweiClientSecret, resolveSecret); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.WNSPushSettings {
+		if err := resolve(fmt.Sprintf("WNSPushSettings[%d].WNSClientSecret", i), &cfg.WNSPushSettings[i].WNSClientSecret, resolveSecret); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.WebPushSettings {
+		if err := resolve(fmt.Sprintf("WebPushSettings[%d].VAPIDPrivateKey", i), &cfg.WebPushSettings[i].VAPIDPrivateKey, resolveSecret); err != nil {
+			return err
+		}
+	}
+
+	if err := resolve("AdminToken", &cfg.AdminToken, resolveSecret); err != nil {
+		return err
+	}
+
+	for serverId, secrets := range cfg.RequestSigningSecrets {
+		for j := range secrets {
+			if err := resolve(fmt.Sprintf("RequestSigningSecrets[%v][%d]", serverId, j), &secrets[j], resolveSecret); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	t.Setenv(SECRETS_KEY_ENV, base64.StdEncoding.EncodeToString(key))
+
+	sealed, err := EncryptSecrets([]byte(`{"service-account": "{\"type\": \"service_account\"}", "signing": "s3cret"}`))
+	require.NoError(t, err)
+	secretsFile := filepath.Join(dir, "secrets.enc")
+	require.NoError(t, os.WriteFile(secretsFile, sealed, 0600))
+
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("from-file\n"), 0600))
+	t.Setenv("TEST_AUTH_KEY", "auth key")
+
+	writeConfig := func(t *testing.T, content string) string {
+		configFile := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(configFile, []byte(content), 0600))
+		return configFile
+	}
+
+	t.Run("references are resolved", func(t *testing.T) {
+		configFile := writeConfig(t, `{
+			"SecretsFile": "`+secretsFile+`",
+			"RequestSigningSecrets": {"server1": ["secret:signing", "plain"]},
+			"ApplePushSettings": [
+				{"Type": "apple", "ApplePushCertPassword": "file:`+passwordFile+`", "ApplePushCertPrivate": "file:/certs/apple.pem"},
+				{"Type": "apple_rn", "ApplePushCertPassword": "plain", "AppleAuthKeyFile": "env:TEST_AUTH_KEY"}
+			],
+			"AndroidPushSettings": [
+				{"Type": "android", "ServiceFileLocation": "secret:service-account"}
+			]
+		}`)
+
+		cfg, err := LoadConfig(configFile)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"s3cret", "plain"}, cfg.RequestSigningSecrets["server1"])
+		assert.Equal(t, "from-file", cfg.ApplePushSettings[0].ApplePushCertPassword)
+		assert.Equal(t, "/certs/apple.pem", cfg.ApplePushSettings[0].ApplePushCertPrivate)
+		assert.Equal(t, "plain", cfg.ApplePushSettings[1].ApplePushCertPassword)
+
+		// Credentials files held by secrets are kept in memory.
+		assert.Equal(t, "env:TEST_AUTH_KEY", cfg.ApplePushSettings[1].AppleAuthKeyFile)
+		authKey, err := readSecretFile(cfg.ApplePushSettings[1].AppleAuthKeyFile, cfg.ApplePushSettings[1].authKey)
+		require.NoError(t, err)
+		assert.Equal(t, "auth key", string(authKey))
+
+		serviceFile, err := readSecretFile(cfg.AndroidPushSettings[0].ServiceFileLocation, cfg.AndroidPushSettings[0].serviceFile)
+		require.NoError(t, err)
+		assert.Equal(t, `{"type": "service_account"}`, string(serviceFile))
+
+		// Loading the same secrets again gives the same settings.
+		reloaded, err := LoadConfig(configFile)
+		require.NoError(t, err)
+		assert.Equal(t, cfg.ApplePushSettings, reloaded.ApplePushSettings)
+		assert.Equal(t, cfg.AndroidPushSettings, reloaded.AndroidPushSettings)
+	})
+
+	t.Run("unresolvable references fail", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"missing file":     `{"ApplePushSettings": [{"Type": "apple", "ApplePushCertPassword": "file:` + filepath.Join(dir, "missing") + `"}]}`,
+			"missing env":      `{"ApplePushSettings": [{"Type": "apple", "ApplePushCertPassword": "env:TEST_MISSING_SECRET"}]}`,
+			"no secrets file":  `{"ApplePushSettings": [{"Type": "apple", "ApplePushCertPassword": "secret:signing"}]}`,
+			"missing secret":   `{"SecretsFile": "` + secretsFile + `", "ApplePushSettings": [{"Type": "apple", "ApplePushCertPassword": "secret:missing"}]}`,
+			"bad secrets file": `{"SecretsFile": "` + passwordFile + `"}`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := LoadConfig(writeConfig(t, content))
+				assert.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		otherKey := make([]byte, 32)
+		_, err := rand.Read(otherKey)
+		require.NoError(t, err)
+		t.Setenv(SECRETS_KEY_ENV, base64.StdEncoding.EncodeToString(otherKey))
+
+		_, err = LoadConfig(writeConfig(t, `{"SecretsFile": "`+secretsFile+`"}`))
+		assert.ErrorContains(t, err, "failed to decrypt secrets file")
+	})
+}
@@ -6,12 +6,15 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -27,31 +30,65 @@ import (
 const (
 	HEADER_FORWARDED           = "X-Forwarded-For"
 	HEADER_REAL_IP             = "X-Real-IP"
+	HEADER_ASYNC               = "X-Push-Async"
+	HEADER_ACCEPT_VERSION      = "Accept-Version"
 	WAIT_FOR_SERVER_SHUTDOWN   = time.Second * 5
 	CONNECTION_TIMEOUT_SECONDS = 60
 	MAX_RETRIES                = 3
+	MAX_BATCH_SIZE             = 500
+	BATCH_CONCURRENCY          = 20
+	// BATCH_TIMEOUT bounds the sends of a batch, leaving time to write the
+	// reply before the connection times out.
+	BATCH_TIMEOUT = (CONNECTION_TIMEOUT_SECONDS - 10) * time.Second
 )
 
+type contextKey string
+
+const statusCodesContextKey contextKey = "status_codes"
+
 type NotificationServer interface {
 	SendNotification(appVersion int, msg *model.PushNotification) PushResponse
 	Initialize() error
 }
 
+// platformNotificationServer is implemented by the targets that know the
+// platform they deliver to.
+type platformNotificationServer interface {
+	NotificationServer
+	Platform() string
+}
+
 // Server is the main struct which performs all activities.
 type Server struct {
-	cfg         *ConfigPushProxy
-	httpServer  *http.Server
-	pushTargets map[string]NotificationServer
-	metrics     *metrics
-	logger      *mlog.Logger
+	configFile string
+	reloadMut  sync.Mutex
+
+	// mut guards the state that is swapped when the config is reloaded.
+	mut            sync.RWMutex
+	cfg            *ConfigPushProxy
+	pushTargets    map[string]NotificationServer
+	targetSettings map[string]pushTargetSettings
+	throttled      http.Handler
+
+	httpServer *http.Server
+	router     *mux.Router
+	jobs       *jobQueue
+	certs      *certReloader
+	health     *healthRegistry
+	metrics    *metrics
+	logger     *mlog.Logger
+	stop       chan struct{}
 }
 
 // New returns a new Server instance.
 func New(cfg *ConfigPushProxy, logger *mlog.Logger) *Server {
 	return &Server{
-		cfg:         cfg,
-		pushTargets: make(map[string]NotificationServer),
-		logger:      logger,
+		cfg:            cfg,
+		pushTargets:    make(map[string]NotificationServer),
+		targetSettings: make(map[string]pushTargetSettings),
+		health:         newHealthRegistry(),
+		logger:         logger,
+		stop:           make(chan struct{}),
 	}
 }
 
@@ -60,64 +97,73 @@ func (s *Server) Start() {
 	v := version.VersionInfo()
 	s.logger.Info("Push proxy server is initializing...", mlog.String("version", v.String()))
 
+	for _, source := range s.cfg.Sources() {
+		s.logger.Info("Config setting loaded", mlog.String("setting", source.Setting), mlog.String("source", source.Source), mlog.String("env", source.EnvName))
+	}
+
 	proxyServer := getProxyServer()
 	if proxyServer != "" {
 		s.logger.Info("Proxy server detected.", mlog.String("proxyServer", proxyServer))
 	}
 
-	var m *metrics
 	if s.cfg.EnableMetrics {
-		m = newMetrics()
-		s.metrics = m
+		s.metrics = newMetrics()
 	}
 
-	for _, settings := range s.cfg.ApplePushSettings {
-		server := NewAppleNotificationServer(settings, s.logger, m, s.cfg.SendTimeoutSec, s.cfg.RetryTimeoutSec)
-		err := server.Initialize()
-		if err != nil {
-			s.logger.Error("Failed to initialize client", mlog.Err(err))
-			continue
-		}
-		s.pushTargets[settings.Type] = server
-	}
+	s.pushTargets, s.targetSettings = s.buildPushTargets(s.cfg, nil, nil)
+	s.checkCredentialsExpiry()
+	go s.watchCredentialsExpiry(CREDENTIALS_EXPIRY_CHECK_INTERVAL)
+	go s.watchCredentialFiles(CREDENTIALS_RELOAD_INTERVAL)
 
-	for _, settings := range s.cfg.AndroidPushSettings {
-		server := NewAndroidNotificationServer(settings, s.logger, m, s.cfg.SendTimeoutSec, s.cfg.RetryTimeoutSec)
-		err := server.Initialize()
-		if err != nil {
-			s.logger.Error("Failed to initialize client", mlog.Err(err))
-			continue
-		}
-		s.pushTargets[settings.Type] = server
-	}
+	s.jobs = newJobQueue(s.logger, s.cfg.AsyncQueueSize, s.cfg.AsyncWorkers, time.Duration(s.cfg.AsyncJobRetentionSec)*time.Second)
 
 	router := mux.NewRouter()
-	vary := throttled.VaryBy{}
-	vary.RemoteAddr = false
-	vary.Headers = strings.Fields(s.cfg.ThrottleVaryByHeader)
-	th := throttled.RateLimit(throttled.PerSec(s.cfg.ThrottlePerSec), &vary, throttledStore.NewMemStore(s.cfg.ThrottleMemoryStoreSize))
-
-	th.DeniedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s.logger.Error("Error: code=429", mlog.String("path", r.URL.Path), mlog.String("ip", s.getIpAddress(r)))
-		throttled.DefaultDeniedHandler.ServeHTTP(w, r)
-	})
-
-	handler := th.Throttle(router)
+	s.router = router
+	s.throttled = s.newThrottle(s.cfg).Throttle(router)
+	handler := http.HandlerFunc(s.serveHTTP)
 
 	router.HandleFunc("/", root).Methods("GET")
 	router.HandleFunc("/version", s.version).Methods("GET")
+	router.HandleFunc("/healthz", s.handleLiveness).Methods("GET")
+	router.HandleFunc("/readyz", s.handleReadiness).Methods("GET")
+
+	sendNotificationHandler := s.requireSignature(s.handleSendNotification)
+	sendNotificationBatchHandler := s.requireSignature(s.handleSendNotificationBatch)
+	ackNotificationHandler := s.requireSignature(s.handleAckNotification)
+	jobStatusHandler := s.requireSignature(s.handleJobStatus)
 
-	metricCompatibleSendNotificationHandler := s.handleSendNotification
-	metricCompatibleAckNotificationHandler := s.handleAckNotification
+	metricCompatibleSendNotificationHandler := sendNotificationHandler
+	metricCompatibleSendNotificationBatchHandler := sendNotificationBatchHandler
+	metricCompatibleAckNotificationHandler := ackNotificationHandler
 	if s.cfg.EnableMetrics {
 		metrics := NewPrometheusHandler()
 		router.Handle("/metrics", metrics).Methods("GET")
-		metricCompatibleSendNotificationHandler = s.responseTimeMiddleware(s.handleSendNotification)
-		metricCompatibleAckNotificationHandler = s.responseTimeMiddleware(s.handleAckNotification)
+		metricCompatibleSendNotificationHandler = s.responseTimeMiddleware(sendNotificationHandler)
+		metricCompatibleSendNotificationBatchHandler = s.responseTimeMiddleware(sendNotificationBatchHandler)
+		metricCompatibleAckNotificationHandler = s.responseTimeMiddleware(ackNotificationHandler)
+	}
+	// v1 always replies 200 and reports failures in the body only. v2 also
+	// sets an HTTP status code matching the response, which v1 clients can
+	// opt in to with the Accept-Version header.
+	v1 := router.PathPrefix("/api/v1").Subrouter()
+	v2 := router.PathPrefix("/api/v2").Subrouter()
+	v2.Use(statusCodesMiddleware)
+	for _, r := range []*mux.Router{v1, v2} {
+		r.HandleFunc("/send_push", metricCompatibleSendNotificationHandler).Methods("POST")
+		r.HandleFunc("/send_push_batch", metricCompatibleSendNotificationBatchHandler).Methods("POST")
+		r.HandleFunc("/ack", metricCompatibleAckNotificationHandler).Methods("POST")
+		r.HandleFunc("/jobs/{id}", jobStatusHandler).Methods("GET")
+	}
+
+	// The notifications of mock targets are only listed when some are
+	// configured at start, and with the same signature as the API.
+	if hasMockDevTarget(s.cfg.DevPushSettings) {
+		router.Handle("/dev/notifications/{type}/{device_id}", statusCodesMiddleware(s.requireSignature(s.handleDevNotifications))).Methods("GET")
+	}
+
+	if s.cfg.EnableAdminEndpoint {
+		router.HandleFunc("/admin/reload", s.handleReload).Methods("POST")
 	}
-	r := router.PathPrefix("/api/v1").Subrouter()
-	r.HandleFunc("/send_push", metricCompatibleSendNotificationHandler).Methods("POST")
-	r.HandleFunc("/ack", metricCompatibleAckNotificationHandler).Methods("POST")
 
 	s.httpServer = &http.Server{
 		Addr:         s.cfg.ListenAddress,
@@ -125,14 +171,78 @@ func (s *Server) Start() {
 		ReadTimeout:  time.Duration(CONNECTION_TIMEOUT_SECONDS) * time.Second,
 		WriteTimeout: time.Duration(CONNECTION_TIMEOUT_SECONDS) * time.Second,
 	}
+
+	if s.cfg.TLSCertFile != "" {
+		certs, err := newCertReloader(s.cfg.TLSCertFile, s.cfg.TLSKeyFile, s.cfg.TLSClientCAFile, s.logger)
+		if err != nil {
+			s.logger.Fatal("Failed to configure TLS", mlog.Err(err))
+		}
+		s.certs = certs
+		s.httpServer.TLSConfig = certs.tlsConfig()
+		go certs.watch(TLS_RELOAD_INTERVAL)
+	}
+
 	go func() {
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.certs != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
 		if err != http.ErrServerClosed {
 			s.logger.Fatal(err.Error())
 		}
 	}()
 
-	s.logger.Info("Server is listening on " + s.cfg.ListenAddress)
+	if s.certs != nil {
+		s.logger.Info("Server is listening with TLS on "+s.cfg.ListenAddress, mlog.Bool("mutual_tls", s.cfg.TLSClientCAFile != ""))
+	} else {
+		s.logger.Info("Server is listening on " + s.cfg.ListenAddress)
+	}
+}
+
+// serveHTTP routes requests through the throttle of the current config.
+// Health probes bypass it, so that a busy instance is not restarted or taken
+// out of rotation because its probes are rate limited.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+		s.router.ServeHTTP(w, r)
+		return
+	}
+
+	s.mut.RLock()
+	h := s.throttled
+	s.mut.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// newThrottle returns the rate limiter configured by cfg.
+func (s *Server) newThrottle(cfg *ConfigPushProxy) *throttled.Throttler {
+	vary := throttled.VaryBy{}
+	vary.RemoteAddr = false
+	vary.Headers = strings.Fields(cfg.ThrottleVaryByHeader)
+	th := throttled.RateLimit(throttled.PerSec(cfg.ThrottlePerSec), &vary, throttledStore.NewMemStore(cfg.ThrottleMemoryStoreSize))
+
+	th.DeniedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.logger.Error("Error: code=429", mlog.String("path", r.URL.Path), mlog.String("ip", s.getIpAddress(r)))
+		throttled.DefaultDeniedHandler.ServeHTTP(w, r)
+	})
+	return th
+}
+
+// config returns the config currently in effect.
+func (s *Server) config() *ConfigPushProxy {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.cfg
+}
+
+// pushTarget returns the push target configured for the given type.
+func (s *Server) pushTarget(pushType string) (NotificationServer, bool) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	server, ok := s.pushTargets[pushType]
+	return server, ok
 }
 
 // Stop stops the server.
@@ -140,6 +250,7 @@ func (s *Server) Stop() {
 	s.logger.Info("Stopping Server...")
 	ctx, cancel := context.WithTimeout(context.Background(), WAIT_FOR_SERVER_SHUTDOWN)
 	defer cancel()
+	close(s.stop)
 	if s.metrics != nil {
 		s.metrics.shutdown()
 	}
@@ -148,6 +259,14 @@ func (s *Server) Stop() {
 	if err != nil {
 		s.logger.Error(err.Error())
 	}
+	// Deliver what was already accepted for asynchronous sending, giving
+	// the sends in flight the time they are allowed to take
+	jobsCtx, cancelJobs := context.WithTimeout(context.Background(), time.Duration(s.config().SendTimeoutSec)*time.Second)
+	defer cancelJobs()
+	s.jobs.shutdown(jobsCtx)
+	if s.certs != nil {
+		s.certs.shutdown()
+	}
 }
 
 func root(w http.ResponseWriter, r *http.Request) {
@@ -182,43 +301,210 @@ func (s *Server) handleSendNotification(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		rMsg := fmt.Sprintf("Failed to read message body: %v", err)
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		if err2 := json.NewEncoder(w).Encode(resp); err2 != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err2))
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false))
+		if s.metrics != nil {
+			s.metrics.incrementBadRequest()
+		}
+		return
+	}
+
+	if errResp := s.checkSignedServerId(r, msg.ServerId); errResp != nil {
+		s.writeResponse(w, r, errResp)
+		return
+	}
+
+	server, appVersion, errResp := s.prepareNotification(&msg)
+	if errResp != nil {
+		s.writeResponse(w, r, errResp)
+		return
+	}
+
+	if isAsyncRequest(r) {
+		jobId, ok := s.jobs.enqueue(server, appVersion, &msg)
+		if !ok {
+			rMsg := fmt.Sprintf("Failed because the async send queue is full serverId=%v", msg.ServerId)
+			s.logger.Error(rMsg)
+			s.writeResponse(w, r, NewErrorPushResponseWithReason(rMsg, REASON_QUEUE_FULL, true))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err2 := json.NewEncoder(w).Encode(NewAcceptedPushResponse(jobId)); err2 != nil {
+			s.logger.Error("Failed to write message", mlog.Err(err2))
+		}
+		return
+	}
+
+	s.writeResponse(w, r, server.SendNotification(appVersion, &msg))
+}
+
+// isAsyncRequest reports whether the caller opted in to asynchronous
+// sending, either with the async query parameter or the X-Push-Async header.
+func isAsyncRequest(r *http.Request) bool {
+	async := r.URL.Query().Get("async")
+	if async == "" {
+		async = r.Header.Get(HEADER_ASYNC)
+	}
+	enabled, _ := strconv.ParseBool(async)
+	return enabled
+}
+
+func (s *Server) handleJobStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, ok := s.jobs.status(id)
+	if !ok {
+		rMsg := fmt.Sprintf("Failed because of unknown job id=%v", id)
+		s.logger.Error(rMsg)
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(rMsg, REASON_JOB_NOT_FOUND, false))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Error("Failed to write message", mlog.Err(err))
+	}
+}
+
+// handleSendNotificationBatch accepts an array of notifications and replies
+// with one PushResponse per notification, in the same order. Every entry goes
+// through the same validation as a single send; valid entries are dispatched
+// concurrently, with at most BATCH_CONCURRENCY sends in flight. Entries not
+// sent within BATCH_TIMEOUT are reported as retryable failures.
+func (s *Server) handleSendNotificationBatch(w http.ResponseWriter, r *http.Request) {
+	msgs, err := decodeBatch(r.Body)
+	if err != nil {
+		rMsg := fmt.Sprintf("Failed to read batch body: %v", err)
+		if errors.Is(err, errBatchTooLarge) {
+			rMsg = fmt.Sprintf("Failed because the batch exceeds the maximum of %v notifications", MAX_BATCH_SIZE)
 		}
+		s.logger.Error(rMsg)
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), BATCH_TIMEOUT)
+	defer cancel()
+
+	// mut guards the responses of the sends, that may still be in flight
+	// when the deadline is reached.
+	var mut sync.Mutex
+	responses := make([]PushResponse, len(msgs))
+	sem := make(chan struct{}, BATCH_CONCURRENCY)
+	var wg sync.WaitGroup
+dispatch:
+	for i := range msgs {
+		if errResp := s.checkSignedServerId(r, msgs[i].ServerId); errResp != nil {
+			responses[i] = errResp
+			continue
+		}
+
+		server, appVersion, errResp := s.prepareNotification(&msgs[i])
+		if errResp != nil {
+			responses[i] = errResp
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
+		}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			resp := server.SendNotification(appVersion, &msgs[i])
+			mut.Lock()
+			defer mut.Unlock()
+			if responses[i] == nil {
+				responses[i] = resp
+			}
+		})
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	for i := range responses {
+		if responses[i] == nil {
+			rMsg := fmt.Sprintf("Failed to send notification within the batch deadline serverId=%v", msgs[i].ServerId)
+			responses[i] = NewErrorPushResponseWithReason(rMsg, REASON_BATCH_TIMEOUT, true)
+		}
+	}
+
+	// Per-notification outcomes are reported in the body, so a processed
+	// batch is a success even when some of its notifications failed.
+	if err2 := json.NewEncoder(w).Encode(responses); err2 != nil {
+		s.logger.Error("Failed to write message", mlog.Err(err2))
+	}
+}
+
+var errBatchTooLarge = errors.New("batch too large")
+
+// decodeBatch decodes a JSON array of notifications, and stops reading with
+// errBatchTooLarge as soon as it has more than MAX_BATCH_SIZE entries.
+func decodeBatch(body io.Reader) ([]model.PushNotification, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("expected an array, got %v", tok)
+	}
+
+	msgs := []model.PushNotification{}
+	for dec.More() {
+		if len(msgs) == MAX_BATCH_SIZE {
+			return nil, errBatchTooLarge
+		}
+		var msg model.PushNotification
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// prepareNotification validates msg, truncates oversized fields and strips the
+// "-vN" app version suffix from its platform. It returns the push target the
+// message must be sent to along with the parsed app version, or a non-nil
+// error response if the message cannot be sent.
+func (s *Server) prepareNotification(msg *model.PushNotification) (NotificationServer, int, PushResponse) {
 	if msg.ServerId == "" {
 		rMsg := "Failed because of missing server Id"
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		if err2 := json.NewEncoder(w).Encode(resp); err2 != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err2))
-		}
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
-		return
+		return nil, 0, NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false)
 	}
 
 	if msg.DeviceId == "" {
 		rMsg := fmt.Sprintf("Failed because of missing device Id serverId=%v", msg.ServerId)
 		s.logger.Error(rMsg)
-		resp := NewErrorPushResponse(rMsg)
-		if err2 := json.NewEncoder(w).Encode(resp); err2 != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err2))
-		}
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
-		return
+		return nil, 0, NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false)
 	}
 
-	if len(msg.Message) > 2047 {
+	// The message of live activity notifications is JSON, that cannot be
+	// truncated.
+	if len(msg.Message) > 2047 && !isLiveActivityTransport(msg.Transport) {
 		msg.Message = msg.Message[0:2046]
 	}
 
@@ -241,26 +527,46 @@ func (s *Server) handleSendNotification(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	if server, ok := s.pushTargets[msg.Platform]; ok {
+	server, ok := s.pushTarget(msg.Platform)
+	if !ok {
+		rMsg := fmt.Sprintf("Did not send message because of missing platform property type=%v serverId=%v", msg.Platform, msg.ServerId)
+		s.logger.Error(rMsg)
 		if s.metrics != nil {
-			s.metrics.incrementNotificationByAppVersion(msg.Platform, appVersion)
+			s.metrics.incrementBadRequest()
 		}
-		rMsg := server.SendNotification(appVersion, &msg)
-		if err2 := json.NewEncoder(w).Encode(rMsg); err2 != nil {
-			s.logger.Error("Failed to write message", mlog.Err(err2))
+		return nil, 0, NewErrorPushResponseWithReason(rMsg, REASON_UNKNOWN_PLATFORM, false)
+	}
+
+	if isLiveActivityTransport(msg.Transport) {
+		if errResp := s.checkLiveActivity(server, msg); errResp != nil {
+			return nil, 0, errResp
 		}
-		return
 	}
-	rMsg := fmt.Sprintf("Did not send message because of missing platform property type=%v serverId=%v", msg.Platform, msg.ServerId)
-	s.logger.Error(rMsg)
-	resp := NewErrorPushResponse(rMsg)
-	err = json.NewEncoder(w).Encode(resp)
-	if err != nil {
-		s.logger.Error("Failed to write response", mlog.Err(err))
+
+	if s.metrics != nil {
+		s.metrics.incrementNotificationByAppVersion(msg.Platform, appVersion)
+	}
+	return server, appVersion, nil
+}
+
+// checkLiveActivity rejects live activity notifications that are not valid,
+// or whose target is not an Apple one.
+func (s *Server) checkLiveActivity(server NotificationServer, msg *model.PushNotification) PushResponse {
+	var rMsg string
+	if ps, ok := server.(platformNotificationServer); !ok || ps.Platform() != model.PushNotifyApple {
+		rMsg = fmt.Sprintf("Did not send live activity notification to a target that is not an Apple one type=%v serverId=%v", msg.Platform, msg.ServerId)
+	} else if _, err := parseLiveActivityUpdate(msg.Message); err != nil {
+		rMsg = fmt.Sprintf("Did not send live activity notification serverId=%v: %v", msg.ServerId, err)
 	}
+	if rMsg == "" {
+		return nil
+	}
+
+	s.logger.Error(rMsg)
 	if s.metrics != nil {
 		s.metrics.incrementBadRequest()
 	}
+	return NewErrorPushResponseWithReason(rMsg, REASON_BAD_REQUEST, false)
 }
 
 func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
@@ -269,10 +575,7 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := fmt.Sprintf("Failed to read ack body: %v", err)
 		s.logger.Error(msg)
-		resp := NewErrorPushResponse(msg)
-		if err2 := json.NewEncoder(w).Encode(resp); err2 != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err2))
-		}
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(msg, REASON_BAD_REQUEST, false))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
@@ -282,10 +585,7 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 	if ack.Id == "" {
 		msg := "Failed because of missing ack Id"
 		s.logger.Error(msg)
-		resp := NewErrorPushResponse(msg)
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err))
-		}
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(msg, REASON_BAD_REQUEST, false))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
@@ -295,10 +595,7 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 	if ack.ClientPlatform == "" {
 		msg := "Failed because of missing ack platform"
 		s.logger.Error(msg)
-		resp := NewErrorPushResponse(msg)
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err))
-		}
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(msg, REASON_BAD_REQUEST, false))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
@@ -308,10 +605,7 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 	if ack.NotificationType == "" {
 		msg := "Failed because of missing ack type"
 		s.logger.Error(msg)
-		resp := NewErrorPushResponse(msg)
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
-			s.logger.Error("Failed to write response", mlog.Err(err))
-		}
+		s.writeResponse(w, r, NewErrorPushResponseWithReason(msg, REASON_BAD_REQUEST, false))
 		if s.metrics != nil {
 			s.metrics.incrementBadRequest()
 		}
@@ -324,12 +618,37 @@ func (s *Server) handleAckNotification(w http.ResponseWriter, r *http.Request) {
 		s.metrics.incrementDelivered(ack.ClientPlatform, ack.NotificationType, model.PushTransportStandard)
 	}
 
-	rMsg := NewOkPushResponse()
-	if err := json.NewEncoder(w).Encode(rMsg); err != nil {
-		s.logger.Error("Failed to write message", mlog.Err(err))
+	s.writeResponse(w, r, NewOkPushResponse())
+}
+
+// writeResponse encodes resp as the body of the reply. The HTTP status code
+// reflects the response only when the client negotiated it, see
+// wantsStatusCodes.
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, resp PushResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if wantsStatusCodes(r) {
+		w.WriteHeader(resp.HTTPStatus())
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Failed to write response", mlog.Err(err))
 	}
 }
 
+// wantsStatusCodes reports whether the request came through the v2 API or
+// asked for version 2 with the Accept-Version header.
+func wantsStatusCodes(r *http.Request) bool {
+	if enabled, _ := r.Context().Value(statusCodesContextKey).(bool); enabled {
+		return true
+	}
+	return r.Header.Get(HEADER_ACCEPT_VERSION) == "2"
+}
+
+func statusCodesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), statusCodesContextKey, true)))
+	})
+}
+
 func (s *Server) getIpAddress(r *http.Request) string {
 	address := r.Header.Get(HEADER_FORWARDED)
 	var err error
@@ -5,12 +5,17 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
+
 	"github.com/mattermost/mattermost-push-proxy/internal/version"
 
 	"github.com/mattermost/mattermost/server/public/model"
@@ -146,3 +151,260 @@ func TestServer_version(t *testing.T) {
 	assert.Equal(t, info.BuildVersion, ret.Version)
 	assert.Equal(t, info.BuildHash, ret.Hash)
 }
+
+// recordingNotificationServer is a NotificationServer that never contacts an
+// upstream service and replies to every device with a preconfigured response.
+type recordingNotificationServer struct {
+	mut       sync.Mutex
+	responses map[string]PushResponse
+	sent      []string
+}
+
+func (rs *recordingNotificationServer) Initialize() error {
+	return nil
+}
+
+func (rs *recordingNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
+	rs.mut.Lock()
+	defer rs.mut.Unlock()
+	rs.sent = append(rs.sent, msg.DeviceId)
+	if resp, ok := rs.responses[msg.DeviceId]; ok {
+		return resp
+	}
+	return NewOkPushResponse()
+}
+
+// blockingNotificationServer is a NotificationServer whose sends only return
+// once release is closed.
+type blockingNotificationServer struct {
+	release chan struct{}
+}
+
+func (bs *blockingNotificationServer) Initialize() error {
+	return nil
+}
+
+func (bs *blockingNotificationServer) SendNotification(_ int, _ *model.PushNotification) PushResponse {
+	<-bs.release
+	return NewOkPushResponse()
+}
+
+func TestSendNotificationBatch(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	target := &recordingNotificationServer{
+		responses: map[string]PushResponse{
+			"stale": NewRemovePushResponse(),
+		},
+	}
+	srv := New(&ConfigPushProxy{}, logger)
+	srv.pushTargets[model.PushNotifyAndroid] = target
+
+	t.Run("responses keep the request order", func(t *testing.T) {
+		msgs := []model.PushNotification{
+			{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid},
+			{DeviceId: "dev2", Platform: model.PushNotifyAndroid},
+			{ServerId: "server1", DeviceId: "stale", Platform: model.PushNotifyAndroid + "-v2"},
+			{ServerId: "server1", DeviceId: "dev4", Platform: "junk"},
+		}
+		buf, err := json.Marshal(msgs)
+		require.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(res, httptest.NewRequest(http.MethodPost, "/api/v1/send_push_batch", bytes.NewReader(buf)))
+
+		var responses []PushResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&responses))
+		require.Len(t, responses, len(msgs))
+		assert.Equal(t, PUSH_STATUS_OK, responses[0][PUSH_STATUS])
+		assert.Equal(t, PUSH_STATUS_FAIL, responses[1][PUSH_STATUS])
+		assert.Equal(t, PUSH_STATUS_REMOVE, responses[2][PUSH_STATUS])
+		assert.Equal(t, PUSH_STATUS_FAIL, responses[3][PUSH_STATUS])
+		assert.ElementsMatch(t, []string{"dev1", "stale"}, target.sent)
+	})
+
+	t.Run("entries not sent before the deadline are retryable failures", func(t *testing.T) {
+		blocked := &blockingNotificationServer{release: make(chan struct{})}
+		defer close(blocked.release)
+		srv.pushTargets[model.PushNotifyApple] = blocked
+		defer delete(srv.pushTargets, model.PushNotifyApple)
+
+		msgs := []model.PushNotification{
+			{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid},
+			{ServerId: "server1", DeviceId: "dev2", Platform: model.PushNotifyApple},
+		}
+		buf, err := json.Marshal(msgs)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		res := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(res, httptest.NewRequestWithContext(ctx, http.MethodPost, "/api/v1/send_push_batch", bytes.NewReader(buf)))
+
+		var responses []PushResponse
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&responses))
+		require.Len(t, responses, len(msgs))
+		assert.Equal(t, PUSH_STATUS_OK, responses[0][PUSH_STATUS])
+		assert.Equal(t, PUSH_STATUS_FAIL, responses[1][PUSH_STATUS])
+		assert.Equal(t, REASON_BATCH_TIMEOUT, responses[1][PUSH_REASON])
+		assert.Equal(t, "true", responses[1][PUSH_RETRYABLE])
+	})
+
+	t.Run("oversized batch is rejected", func(t *testing.T) {
+		msgs := make([]model.PushNotification, MAX_BATCH_SIZE+1)
+		buf, err := json.Marshal(msgs)
+		require.NoError(t, err)
+
+		res := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(res, httptest.NewRequest(http.MethodPost, "/api/v1/send_push_batch", bytes.NewReader(buf)))
+
+		pr := PushResponseFromJson(res.Body)
+		assert.Equal(t, PUSH_STATUS_FAIL, pr[PUSH_STATUS])
+	})
+
+	t.Run("oversized batch is rejected before the rest is read", func(t *testing.T) {
+		body := "[" + strings.Repeat("{},", MAX_BATCH_SIZE+1) + "not json"
+
+		res := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(res, httptest.NewRequest(http.MethodPost, "/api/v1/send_push_batch", strings.NewReader(body)))
+
+		pr := PushResponseFromJson(res.Body)
+		assert.Equal(t, PUSH_STATUS_FAIL, pr[PUSH_STATUS])
+		assert.Contains(t, pr[PUSH_STATUS_ERROR_MSG], "exceeds the maximum")
+	})
+
+	t.Run("non-array body is rejected", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		srv.handleSendNotificationBatch(res, httptest.NewRequest(http.MethodPost, "/api/v1/send_push_batch", strings.NewReader(`{"device_id":"dev1"}`)))
+
+		pr := PushResponseFromJson(res.Body)
+		assert.Equal(t, PUSH_STATUS_FAIL, pr[PUSH_STATUS])
+		assert.Equal(t, REASON_BAD_REQUEST, pr[PUSH_REASON])
+	})
+}
+
+func TestSendNotificationAsync(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	srv := New(&ConfigPushProxy{}, logger)
+	srv.pushTargets[model.PushNotifyAndroid] = &recordingNotificationServer{}
+	srv.jobs = newJobQueue(logger, 10, 1, time.Minute)
+	defer srv.jobs.shutdown(context.Background())
+
+	buf, err := json.Marshal(model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid})
+	require.NoError(t, err)
+
+	res := httptest.NewRecorder()
+	srv.handleSendNotification(res, httptest.NewRequest(http.MethodPost, "/api/v1/send_push?async=true", bytes.NewReader(buf)))
+	require.Equal(t, http.StatusAccepted, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+	pr := PushResponseFromJson(res.Body)
+	require.Equal(t, PUSH_STATUS_ACCEPTED, pr[PUSH_STATUS])
+	jobId := pr[PUSH_JOB_ID]
+	require.NotEmpty(t, jobId)
+
+	require.Eventually(t, func() bool {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/jobs/"+jobId, nil), map[string]string{"id": jobId})
+		res := httptest.NewRecorder()
+		srv.handleJobStatus(res, req)
+		assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+
+		var status JobStatus
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+		return status.Status == JOB_STATUS_DONE && status.Response[PUSH_STATUS] == PUSH_STATUS_OK
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSendNotificationStatusCodes(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	srv := New(&ConfigPushProxy{}, logger)
+	srv.pushTargets[model.PushNotifyAndroid] = &recordingNotificationServer{}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/send_push", srv.handleSendNotification)
+	v2 := router.PathPrefix("/api/v2").Subrouter()
+	v2.Use(statusCodesMiddleware)
+	v2.HandleFunc("/send_push", srv.handleSendNotification)
+
+	send := func(path string, header http.Header, msg any) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(msg)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(buf))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	valid := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid}
+	junk := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: "junk"}
+	missingServer := model.PushNotification{DeviceId: "dev1", Platform: model.PushNotifyAndroid}
+
+	t.Run("v1 always replies 200", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("/api/v1/send_push", nil, valid).Code)
+		assert.Equal(t, http.StatusOK, send("/api/v1/send_push", nil, junk).Code)
+		assert.Equal(t, http.StatusOK, send("/api/v1/send_push", nil, missingServer).Code)
+		assert.Equal(t, http.StatusOK, send("/api/v1/send_push", nil, "not a notification").Code)
+	})
+
+	t.Run("v2 replies with matching status codes", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("/api/v2/send_push", nil, valid).Code)
+		assert.Equal(t, http.StatusNotFound, send("/api/v2/send_push", nil, junk).Code)
+		assert.Equal(t, http.StatusBadRequest, send("/api/v2/send_push", nil, missingServer).Code)
+
+		res := send("/api/v2/send_push", nil, "not a notification")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		pr := PushResponseFromJson(res.Body)
+		assert.Equal(t, REASON_BAD_REQUEST, pr[PUSH_REASON])
+	})
+
+	t.Run("v1 negotiates status codes with Accept-Version", func(t *testing.T) {
+		header := http.Header{HEADER_ACCEPT_VERSION: []string{"2"}}
+		assert.Equal(t, http.StatusNotFound, send("/api/v1/send_push", header, junk).Code)
+	})
+}
+
+func TestSendLiveActivityNotification(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	apple := &recordingNotificationServer{}
+	android := &recordingNotificationServer{}
+	srv := New(&ConfigPushProxy{}, logger)
+	srv.pushTargets[model.PushNotifyApple] = srv.health.track(model.PushNotifyApple, model.PushNotifyApple, apple)
+	srv.pushTargets[model.PushNotifyAndroid] = srv.health.track(model.PushNotifyAndroid, model.PushNotifyAndroid, android)
+
+	// Longer than the messages that are truncated.
+	update := `{"event":"update","content_state":{"summary":"` + strings.Repeat("a", 2100) + `"}}`
+
+	t.Run("updates are sent to apple targets without truncation", func(t *testing.T) {
+		msg := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyApple, Transport: PUSH_TRANSPORT_LIVE_ACTIVITY, Message: update}
+		target, _, errResp := srv.prepareNotification(&msg)
+		require.Nil(t, errResp)
+		assert.Equal(t, update, msg.Message)
+		assert.Equal(t, NewOkPushResponse(), target.SendNotification(1, &msg))
+		assert.Equal(t, []string{"dev1"}, apple.sent)
+	})
+
+	t.Run("invalid updates are rejected", func(t *testing.T) {
+		msg := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyApple, Transport: PUSH_TRANSPORT_LIVE_ACTIVITY, Message: "hello"}
+		_, _, errResp := srv.prepareNotification(&msg)
+		require.NotNil(t, errResp)
+		assert.Equal(t, REASON_BAD_REQUEST, errResp[PUSH_REASON])
+	})
+
+	t.Run("other platforms are rejected", func(t *testing.T) {
+		msg := model.PushNotification{ServerId: "server1", DeviceId: "dev1", Platform: model.PushNotifyAndroid, Transport: PUSH_TRANSPORT_LIVE_ACTIVITY, Message: update}
+		_, _, errResp := srv.prepareNotification(&msg)
+		require.NotNil(t, errResp)
+		assert.Equal(t, REASON_BAD_REQUEST, errResp[PUSH_REASON])
+		assert.Empty(t, android.sent)
+	})
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// TLS_RELOAD_INTERVAL is how often the listener's certificate files are
+// checked for changes.
+const TLS_RELOAD_INTERVAL = 30 * time.Second
+
+// certReloader serves the listener's certificate, and the CAs trusted for
+// client certificates, reloading them whenever the files change on disk.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *mlog.Logger
+
+	mut       sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+
+	stop chan struct{}
+}
+
+func newCertReloader(certFile, keyFile, clientCAFile string, logger *mlog.Logger) (*certReloader, error) {
+	cr := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger,
+		stop:         make(chan struct{}),
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.clientCAFile != "" {
+		files = append(files, cr.clientCAFile)
+	}
+	return files
+}
+
+// load reads the certificate files. The previous certificate is kept when
+// any of them cannot be loaded.
+func (cr *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if cr.clientCAFile != "" {
+		clientCAs, err = loadCertPool(cr.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS client CA file: %w", err)
+		}
+	}
+
+	cr.mut.Lock()
+	defer cr.mut.Unlock()
+	cr.cert = &cert
+	cr.clientCAs = clientCAs
+	cr.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether any of the files was modified since it was last
+// loaded.
+func (cr *certReloader) changed() bool {
+	cr.mut.RLock()
+	defer cr.mut.RUnlock()
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(cr.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !cr.changed() {
+			continue
+		}
+		if err := cr.load(); err != nil {
+			cr.logger.Error("Failed to reload TLS certificate, keeping the current one", mlog.Err(err))
+			continue
+		}
+		cr.logger.Info("Reloaded TLS certificate", mlog.String("cert", cr.certFile))
+	}
+}
+
+// loadCertPool returns a pool of the PEM certificates found in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found")
+	}
+	return pool, nil
+}
+
+func (cr *certReloader) shutdown() {
+	close(cr.stop)
+}
+
+// tlsConfig returns a configuration that always uses the most recently
+// loaded certificate, and requires a client certificate signed by one of the
+// client CAs when a client CA file is configured.
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mut.RLock()
+			defer cr.mut.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if cr.clientCAs != nil {
+				cfg.ClientCAs = cr.clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
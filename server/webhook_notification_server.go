@@ -0,0 +1,206 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// PUSH_NOTIFY_WEBHOOK is the platform of webhook targets in metrics and
+// health reports.
+const PUSH_NOTIFY_WEBHOOK = "webhook"
+
+// WebhookNotificationServer posts notifications as JSON to the URL devices
+// registered with, such as the endpoint of a UnifiedPush distributor or of
+// a self-hosted relay.
+type WebhookNotificationServer struct {
+	metrics             *metrics
+	logger              *mlog.Logger
+	WebhookPushSettings WebhookPushSettings
+	client              *http.Client
+	sendTimeout         time.Duration
+	retryTimeout        time.Duration
+}
+
+func NewWebhookNotificationServer(settings WebhookPushSettings, logger *mlog.Logger, metrics *metrics, sendTimeoutSecs int, retryTimeoutSecs int) *WebhookNotificationServer {
+	return &WebhookNotificationServer{
+		WebhookPushSettings: settings,
+		metrics:             metrics,
+		logger:              logger,
+		sendTimeout:         time.Duration(sendTimeoutSecs) * time.Second,
+		retryTimeout:        time.Duration(retryTimeoutSecs) * time.Second,
+	}
+}
+
+func (me *WebhookNotificationServer) Initialize() error {
+	me.logger.Info("Initializing webhook notification server", mlog.String("type", me.WebhookPushSettings.Type), mlog.Any("allowed_hosts", me.WebhookPushSettings.AllowedHosts))
+
+	if len(me.WebhookPushSettings.AllowedHosts) == 0 {
+		return fmt.Errorf("webhook push notifications not configured: missing AllowedHosts for type=%v", me.WebhookPushSettings.Type)
+	}
+
+	me.client = &http.Client{
+		// Redirects could lead to hosts that are not allowed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (me *WebhookNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
+	pushType := msg.Type
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard)
+	}
+
+	endpoint, err := url.Parse(msg.DeviceId)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "https" && (endpoint.Scheme != "http" || !me.WebhookPushSettings.AllowHTTP)) {
+		me.logger.Info(
+			"Failed to parse webhook endpoint sending remove code",
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.String("type", me.WebhookPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard, "InvalidEndpoint")
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("WEBHOOK", "INVALID_ENDPOINT"))
+	}
+	if !me.isAllowedHost(endpoint.Hostname()) {
+		me.logger.Warn(
+			"Did not send webhook push to a host that is not allowed",
+			mlog.String("host", endpoint.Hostname()),
+			mlog.String("sid", msg.ServerId),
+			mlog.String("type", me.WebhookPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard, "HostNotAllowed")
+		}
+		return NewErrorPushResponseWithReason("webhook host is not allowed", upstreamReason("WEBHOOK", "HOST_NOT_ALLOWED"), false)
+	}
+
+	body, err := json.Marshal(notificationData(msg))
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+
+	me.logger.Info(
+		"Sending webhook push notification",
+		mlog.String("device", me.WebhookPushSettings.Type),
+		mlog.String("type", msg.Type),
+		mlog.String("ack_id", msg.AckId),
+		mlog.String("host", endpoint.Hostname()),
+	)
+	status, err := me.SendNotificationWithRetry(endpoint.String(), body)
+	if err != nil {
+		me.logger.Error(
+			"Failed to send webhook push",
+			mlog.String("sid", msg.ServerId),
+			mlog.String("host", endpoint.Hostname()),
+			mlog.Err(err),
+			mlog.String("type", me.WebhookPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard, "RequestError")
+		}
+		return NewErrorPushResponseWithReason("unknown transport error", transportErrorReason(err), true)
+	}
+
+	reason := httpStatusReason(status)
+	switch {
+	case status >= 200 && status < 300:
+		if me.metrics != nil {
+			if msg.AckId != "" {
+				me.metrics.incrementSuccessWithAck(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard)
+			} else {
+				me.metrics.incrementSuccess(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard)
+			}
+		}
+		return NewOkPushResponse()
+	case status == http.StatusNotFound || status == http.StatusGone:
+		// The distributor no longer knows the endpoint, e.g. the app was
+		// uninstalled.
+		me.logger.Info(
+			"Failed to send webhook push sending remove code res",
+			mlog.Int("code", status),
+			mlog.String("host", endpoint.Hostname()),
+			mlog.String("type", me.WebhookPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard, reason)
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("WEBHOOK", reason))
+	}
+
+	me.logger.Error(
+		"Failed to send webhook push with res",
+		mlog.String("sid", msg.ServerId),
+		mlog.String("host", endpoint.Hostname()),
+		mlog.Int("code", status),
+		mlog.String("type", me.WebhookPushSettings.Type),
+	)
+	if me.metrics != nil {
+		me.metrics.incrementFailure(PUSH_NOTIFY_WEBHOOK, pushType, model.PushTransportStandard, reason)
+	}
+	return NewErrorPushResponseWithReason("unknown send response error", upstreamReason("WEBHOOK", reason), isRetryableHTTPStatus(status))
+}
+
+// isAllowedHost reports whether host matches one of AllowedHosts.
+func (me *WebhookNotificationServer) isAllowedHost(host string) bool {
+	return matchesHostPattern(host, me.WebhookPushSettings.AllowedHosts)
+}
+
+// matchesHostPattern reports whether host matches one of patterns, where a
+// pattern starting with "*." matches every subdomain of the rest.
+func matchesHostPattern(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (me *WebhookNotificationServer) SendNotificationWithRetry(endpoint string, body []byte) (int, error) {
+	var status int
+	err := retryWithBackoff(me.logger, me.metrics, PUSH_NOTIFY_WEBHOOK, me.sendTimeout, me.retryTimeout, func(ctx context.Context) (bool, error) {
+		var err error
+		status, err = me.post(ctx, endpoint, body)
+		return err != nil || isRetryableHTTPStatus(status), err
+	})
+	return status, err
+}
+
+func (me *WebhookNotificationServer) post(ctx context.Context, endpoint string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := me.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	return res.StatusCode, nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestWebhookNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	var mut sync.Mutex
+	var received []map[string]string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+			return
+		case "/redirect":
+			http.Redirect(w, r, "http://internal.example.com/", http.StatusFound)
+			return
+		}
+
+		var data map[string]string
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&data))
+		mut.Lock()
+		received = append(received, data)
+		mut.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer relay.Close()
+
+	srv := NewWebhookNotificationServer(WebhookPushSettings{
+		Type:         "unifiedpush",
+		AllowedHosts: []string{"127.0.0.1", "*.unifiedpush.example.com"},
+		AllowHTTP:    true,
+	}, logger, nil, 5, 1)
+	require.NoError(t, srv.Initialize())
+
+	t.Run("notifications are posted to the device URL", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: relay.URL + "/up/device", Type: model.PushTypeMessage, Message: "hello", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		require.Len(t, received, 1)
+		assert.Equal(t, "hello", received[0]["message"])
+		assert.Equal(t, "channel", received[0]["channel_id"])
+	})
+
+	t.Run("gone endpoints are removed", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: relay.URL + "/gone", Type: model.PushTypeMessage})
+		assert.Equal(t, NewRemovePushResponseWithReason("WEBHOOK_GONE"), resp)
+	})
+
+	t.Run("redirects are not followed", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: relay.URL + "/redirect", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "WEBHOOK_FOUND", resp[PUSH_REASON])
+	})
+
+	t.Run("hosts that are not allowed are rejected", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "https://metadata.internal/latest", Type: model.PushTypeMessage})
+		assert.Equal(t, NewErrorPushResponseWithReason("webhook host is not allowed", "WEBHOOK_HOST_NOT_ALLOWED", false), resp)
+	})
+
+	t.Run("invalid endpoints are removed", func(t *testing.T) {
+		for _, deviceID := range []string{"not a url", "ftp://127.0.0.1/up", "/up/device"} {
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: deviceID, Type: model.PushTypeMessage})
+			assert.Equal(t, NewRemovePushResponseWithReason("WEBHOOK_INVALID_ENDPOINT"), resp, deviceID)
+		}
+
+		httpsOnly := NewWebhookNotificationServer(WebhookPushSettings{Type: "unifiedpush", AllowedHosts: []string{"127.0.0.1"}}, logger, nil, 5, 1)
+		require.NoError(t, httpsOnly.Initialize())
+		resp := httpsOnly.SendNotification(2, &model.PushNotification{DeviceId: relay.URL + "/up/device", Type: model.PushTypeMessage})
+		assert.Equal(t, NewRemovePushResponseWithReason("WEBHOOK_INVALID_ENDPOINT"), resp)
+	})
+
+	t.Run("allowed host patterns", func(t *testing.T) {
+		assert.True(t, srv.isAllowedHost("eu.unifiedpush.example.com"))
+		assert.True(t, srv.isAllowedHost("EU.UnifiedPush.example.com."))
+		assert.False(t, srv.isAllowedHost("unifiedpush.example.com"))
+		assert.False(t, srv.isAllowedHost("evilunifiedpush.example.com"))
+		assert.False(t, srv.isAllowedHost("127.0.0.2"))
+	})
+}
@@ -0,0 +1,446 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// PUSH_NOTIFY_WEB is the platform of Web Push targets in metrics and
+	// health reports.
+	PUSH_NOTIFY_WEB      = "web"
+	WEBPUSH_DEFAULT_TTL  = 24 * time.Hour
+	WEBPUSH_RECORD_SIZE  = 4096
+	VAPID_TOKEN_LIFETIME = 12 * time.Hour
+)
+
+var webPushInvalidSubscription = upstreamReason("WEBPUSH", "INVALID_SUBSCRIPTION")
+
+// errWebPushPayloadTooLarge is returned for notifications that don't fit in
+// a single record once encrypted.
+var errWebPushPayloadTooLarge = errors.New("payload is too large for web push")
+
+// webPushServiceHosts are the hosts of the push services of Chrome, Firefox,
+// Safari and Edge.
+var webPushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"*.push.services.mozilla.com",
+	"*.push.apple.com",
+	"*.notify.windows.com",
+}
+
+// webPushSubscription is the JSON encoding of a browser PushSubscription.
+type webPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type vapidToken struct {
+	authorization string
+	expiresAt     time.Time
+}
+
+// WebPushNotificationServer delivers notifications to browsers through the
+// push service of their subscription, as described by RFC 8030. Payloads are
+// encrypted as described by RFC 8291, and the proxy identifies itself with
+// VAPID (RFC 8292).
+type WebPushNotificationServer struct {
+	metrics         *metrics
+	logger          *mlog.Logger
+	WebPushSettings WebPushSettings
+	client          *http.Client
+	allowedHosts    []string
+	vapidKey        *ecdsa.PrivateKey
+	ttl             time.Duration
+	sendTimeout     time.Duration
+	retryTimeout    time.Duration
+
+	// tokens caches the VAPID authorization of each push service.
+	mut    sync.Mutex
+	tokens map[string]vapidToken
+}
+
+func NewWebPushNotificationServer(settings WebPushSettings, logger *mlog.Logger, metrics *metrics, sendTimeoutSecs int, retryTimeoutSecs int) *WebPushNotificationServer {
+	return &WebPushNotificationServer{
+		WebPushSettings: settings,
+		metrics:         metrics,
+		logger:          logger,
+		sendTimeout:     time.Duration(sendTimeoutSecs) * time.Second,
+		retryTimeout:    time.Duration(retryTimeoutSecs) * time.Second,
+		tokens:          make(map[string]vapidToken),
+	}
+}
+
+func (me *WebPushNotificationServer) Initialize() error {
+	me.logger.Info("Initializing web push notification server", mlog.String("type", me.WebPushSettings.Type))
+
+	if me.WebPushSettings.VAPIDPrivateKey == "" {
+		return fmt.Errorf("web push notifications not configured: missing VAPIDPrivateKey for type=%v", me.WebPushSettings.Type)
+	}
+	key, err := parseVAPIDPrivateKey(me.WebPushSettings.VAPIDPrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to initialize web push notification service with VAPIDPrivateKey err=%v for type=%v", err, me.WebPushSettings.Type)
+	}
+	if !strings.HasPrefix(me.WebPushSettings.VAPIDSubject, "mailto:") && !strings.HasPrefix(me.WebPushSettings.VAPIDSubject, "https://") {
+		return fmt.Errorf("web push notifications not configured: VAPIDSubject must be a mailto: or https: URL for type=%v", me.WebPushSettings.Type)
+	}
+
+	me.vapidKey = key
+	me.ttl = WEBPUSH_DEFAULT_TTL
+	if me.WebPushSettings.TTLSec > 0 {
+		me.ttl = time.Duration(me.WebPushSettings.TTLSec) * time.Second
+	}
+	me.allowedHosts = webPushServiceHosts
+	if len(me.WebPushSettings.AllowedHosts) > 0 {
+		me.allowedHosts = me.WebPushSettings.AllowedHosts
+		me.logger.Info("Sending web push notifications to custom push services", mlog.String("type", me.WebPushSettings.Type), mlog.Any("hosts", me.allowedHosts))
+	}
+	me.client = &http.Client{
+		// Redirects could lead to hosts that are not allowed.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return nil
+}
+
+func (me *WebPushNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
+	pushType := msg.Type
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard)
+	}
+
+	sub, uaKey, authSecret, err := parseWebPushSubscription(msg.DeviceId)
+	if err != nil {
+		me.logger.Info(
+			"Failed to parse web push subscription sending remove code",
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.Err(err),
+			mlog.String("type", me.WebPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, "InvalidSubscription")
+		}
+		return NewRemovePushResponseWithReason(webPushInvalidSubscription)
+	}
+	if endpoint, _ := url.Parse(sub.Endpoint); !matchesHostPattern(endpoint.Hostname(), me.allowedHosts) {
+		me.logger.Warn(
+			"Did not send web push to a host that is not allowed",
+			mlog.String("host", endpoint.Hostname()),
+			mlog.String("sid", msg.ServerId),
+			mlog.String("type", me.WebPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, "HostNotAllowed")
+		}
+		return NewErrorPushResponseWithReason("web push host is not allowed", upstreamReason("WEBPUSH", "HOST_NOT_ALLOWED"), false)
+	}
+
+	plaintext, err := json.Marshal(notificationData(msg))
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+	body, err := encryptWebPushPayload(plaintext, uaKey, authSecret)
+	if err != nil {
+		me.logger.Error("Failed to encrypt web push payload", mlog.Err(err), mlog.String("type", me.WebPushSettings.Type))
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, "EncryptionError")
+		}
+		if errors.Is(err, errWebPushPayloadTooLarge) {
+			return NewErrorPushResponseWithReason(err.Error(), upstreamReason("WEBPUSH", "PAYLOAD_TOO_LARGE"), false)
+		}
+		return NewErrorPushResponse(err.Error())
+	}
+
+	me.logger.Info(
+		"Sending web push notification",
+		mlog.String("device", me.WebPushSettings.Type),
+		mlog.String("type", msg.Type),
+		mlog.String("ack_id", msg.AckId),
+	)
+	status, err := me.SendNotificationWithRetry(sub.Endpoint, body)
+	if err != nil {
+		me.logger.Error(
+			"Failed to send web push",
+			mlog.String("sid", msg.ServerId),
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.Err(err),
+			mlog.String("type", me.WebPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, "RequestError")
+		}
+		return NewErrorPushResponseWithReason("unknown transport error", transportErrorReason(err), true)
+	}
+
+	reason := httpStatusReason(status)
+	switch {
+	case status >= 200 && status < 300:
+		if me.metrics != nil {
+			if msg.AckId != "" {
+				me.metrics.incrementSuccessWithAck(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard)
+			} else {
+				me.metrics.incrementSuccess(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard)
+			}
+		}
+		return NewOkPushResponse()
+	case status == http.StatusNotFound || status == http.StatusGone:
+		// The subscription expired or the user unsubscribed.
+		me.logger.Info(
+			"Failed to send web push sending remove code res",
+			mlog.Int("code", status),
+			mlog.String("type", me.WebPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, reason)
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("WEBPUSH", reason))
+	}
+
+	me.logger.Error(
+		"Failed to send web push with res",
+		mlog.String("sid", msg.ServerId),
+		mlog.String("did", redactToken(msg.DeviceId)),
+		mlog.Int("code", status),
+		mlog.String("type", me.WebPushSettings.Type),
+	)
+	if me.metrics != nil {
+		me.metrics.incrementFailure(PUSH_NOTIFY_WEB, pushType, model.PushTransportStandard, reason)
+	}
+	return NewErrorPushResponseWithReason("unknown send response error", upstreamReason("WEBPUSH", reason), isRetryableHTTPStatus(status))
+}
+
+func (me *WebPushNotificationServer) SendNotificationWithRetry(endpoint string, body []byte) (int, error) {
+	var status int
+	err := retryWithBackoff(me.logger, me.metrics, PUSH_NOTIFY_WEB, me.sendTimeout, me.retryTimeout, func(ctx context.Context) (bool, error) {
+		var err error
+		status, err = me.push(ctx, endpoint, body)
+		return err != nil || isRetryableHTTPStatus(status), err
+	})
+	return status, err
+}
+
+// push posts an encrypted payload to a push service and returns the status
+// code of its response.
+func (me *WebPushNotificationServer) push(ctx context.Context, endpoint string, body []byte) (int, error) {
+	authorization, err := me.vapidAuthorization(endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(me.ttl.Seconds())))
+	req.Header.Set("Urgency", "high")
+
+	res, err := me.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, WEBPUSH_RECORD_SIZE))
+	return res.StatusCode, nil
+}
+
+// vapidAuthorization returns the Authorization header for the push service
+// of endpoint. Tokens are reused until they get close to expiring.
+func (me *WebPushNotificationServer) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	if token, ok := me.tokens[audience]; ok && time.Until(token.expiresAt) > VAPID_TOKEN_LIFETIME/2 {
+		return token.authorization, nil
+	}
+
+	expiresAt := time.Now().Add(VAPID_TOKEN_LIFETIME)
+	jwt, err := signVAPIDToken(me.vapidKey, audience, me.WebPushSettings.VAPIDSubject, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := me.vapidKey.PublicKey.Bytes()
+	if err != nil {
+		return "", err
+	}
+	token := vapidToken{
+		authorization: "vapid t=" + jwt + ", k=" + base64.RawURLEncoding.EncodeToString(publicKey),
+		expiresAt:     expiresAt,
+	}
+	me.tokens[audience] = token
+	return token.authorization, nil
+}
+
+// signVAPIDToken returns the ES256 signed JWT identifying the proxy to the
+// push service at audience.
+func signVAPIDToken(key *ecdsa.PrivateKey, audience, subject string, expiresAt time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]any{
+		"aud": audience,
+		"exp": expiresAt.Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseWebPushSubscription decodes a device id into its subscription, the
+// public key of the browser and the authentication secret.
+func parseWebPushSubscription(deviceID string) (*webPushSubscription, *ecdh.PublicKey, []byte, error) {
+	var sub webPushSubscription
+	if err := json.Unmarshal([]byte(deviceID), &sub); err != nil {
+		return nil, nil, nil, fmt.Errorf("subscription is not valid JSON: %w", err)
+	}
+
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, nil, nil, errors.New("subscription endpoint is not an https URL")
+	}
+	uaPublic, err := decodeBase64URL(sub.Keys.P256dh)
+	if err != nil {
+		return nil, nil, nil, errors.New("subscription p256dh key is not a base64url encoded P-256 public key")
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("subscription p256dh key is not a P-256 public key: %w", err)
+	}
+	authSecret, err := decodeBase64URL(sub.Keys.Auth)
+	if err != nil || len(authSecret) != 16 {
+		return nil, nil, nil, errors.New("subscription auth secret is not 16 base64url encoded bytes")
+	}
+	return &sub, uaKey, authSecret, nil
+}
+
+// encryptWebPushPayload encrypts plaintext for the browser with public key
+// uaKey and authentication secret authSecret, as a single aes128gcm record
+// (RFC 8291).
+func encryptWebPushPayload(plaintext []byte, uaKey *ecdh.PublicKey, authSecret []byte) ([]byte, error) {
+	uaPublic := uaKey.Bytes()
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, "WebPush: info\x00"+string(uaPublic)+string(asPublic), 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last and only record ends with the 0x02 padding delimiter.
+	record := append(append(make([]byte, 0, len(plaintext)+1), plaintext...), 0x02)
+	header := make([]byte, 0, 21+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, WEBPUSH_RECORD_SIZE)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	if len(header)+len(record)+gcm.Overhead() > WEBPUSH_RECORD_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes", errWebPushPayloadTooLarge, len(plaintext))
+	}
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// parseVAPIDPrivateKey decodes a base64url encoded P-256 private key.
+func parseVAPIDPrivateKey(encoded string) (*ecdsa.PrivateKey, error) {
+	raw, err := decodeBase64URL(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+}
+
+// GenerateVAPIDKeys returns a new base64url encoded VAPID key pair, for
+// VAPIDPrivateKey and for the applicationServerKey of subscriptions.
+func GenerateVAPIDKeys() (privateKey string, publicKey string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	priv, err := key.Bytes()
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := key.PublicKey.Bytes()
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(priv), base64.RawURLEncoding.EncodeToString(pub), nil
+}
+
+// decodeBase64URL decodes base64url, with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
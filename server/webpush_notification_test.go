@@ -0,0 +1,241 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+// decryptWebPushPayload decrypts a payload as a browser would.
+func decryptWebPushPayload(t *testing.T, body []byte, uaKey *ecdh.PrivateKey, authSecret []byte) []byte {
+	t.Helper()
+
+	require.Greater(t, len(body), 21)
+	salt := body[:16]
+	assert.Equal(t, uint32(WEBPUSH_RECORD_SIZE), binary.BigEndian.Uint32(body[16:20]))
+	keyLen := int(body[20])
+	asPublic := body[21 : 21+keyLen]
+
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	require.NoError(t, err)
+	ecdhSecret, err := uaKey.ECDH(asKey)
+	require.NoError(t, err)
+
+	uaPublic := uaKey.PublicKey().Bytes()
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, "WebPush: info\x00"+string(uaPublic)+string(asPublic), 32)
+	require.NoError(t, err)
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	require.NoError(t, err)
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	require.NoError(t, err)
+
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	record, err := gcm.Open(nil, nonce, body[21+keyLen:], nil)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x02), record[len(record)-1])
+	return record[:len(record)-1]
+}
+
+// verifyVAPIDAuthorization checks the VAPID header of a request and returns
+// the claims of its token.
+func verifyVAPIDAuthorization(t *testing.T, authorization string, publicKey *ecdsa.PublicKey) map[string]any {
+	t.Helper()
+
+	var jwt, k string
+	for part := range strings.SplitSeq(strings.TrimPrefix(authorization, "vapid "), ", ") {
+		if value, ok := strings.CutPrefix(part, "t="); ok {
+			jwt = value
+		} else if value, ok := strings.CutPrefix(part, "k="); ok {
+			k = value
+		}
+	}
+	expected, err := publicKey.Bytes()
+	require.NoError(t, err)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(expected), k)
+
+	parts := strings.Split(jwt, ".")
+	require.Len(t, parts, 3)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, signature, 64)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	assert.True(t, ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])))
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	var claims map[string]any
+	require.NoError(t, json.Unmarshal(claimsJSON, &claims))
+	return claims
+}
+
+func TestWebPushNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	var mut sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	statuses := map[string]int{}
+	pushService := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mut.Lock()
+		defer mut.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		status, ok := statuses[r.URL.Path]
+		if !ok {
+			status = http.StatusCreated
+		}
+		if status == http.StatusFound {
+			w.Header().Set("Location", "/push/ok")
+		}
+		w.WriteHeader(status)
+	}))
+	defer pushService.Close()
+
+	privateKey, _, err := GenerateVAPIDKeys()
+	require.NoError(t, err)
+	vapidKey, err := parseVAPIDPrivateKey(privateKey)
+	require.NoError(t, err)
+
+	srv := NewWebPushNotificationServer(WebPushSettings{
+		Type:            "web",
+		VAPIDPrivateKey: privateKey,
+		VAPIDSubject:    "mailto:admin@example.com",
+		TTLSec:          60,
+		AllowedHosts:    []string{"127.0.0.1"},
+	}, logger, nil, 5, 1)
+	require.NoError(t, srv.Initialize())
+	srv.client.Transport = pushService.Client().Transport
+
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authSecret := make([]byte, 16)
+	_, err = rand.Read(authSecret)
+	require.NoError(t, err)
+	subscription := func(path string) string {
+		buf, err := json.Marshal(map[string]any{
+			"endpoint": pushService.URL + path,
+			"keys": map[string]string{
+				"p256dh": base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+				"auth":   base64.RawURLEncoding.EncodeToString(authSecret),
+			},
+		})
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	t.Run("payload is encrypted for the subscription", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: subscription("/push/ok"), Type: model.PushTypeMessage, Message: "hello", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		require.Len(t, received, 1)
+		req := received[0]
+		assert.Equal(t, "aes128gcm", req.Header.Get("Content-Encoding"))
+		assert.Equal(t, "60", req.Header.Get("TTL"))
+
+		claims := verifyVAPIDAuthorization(t, req.Header.Get("Authorization"), &vapidKey.PublicKey)
+		assert.Equal(t, pushService.URL, claims["aud"])
+		assert.Equal(t, "mailto:admin@example.com", claims["sub"])
+
+		var data map[string]string
+		require.NoError(t, json.Unmarshal(decryptWebPushPayload(t, bodies[0], uaKey, authSecret), &data))
+		assert.Equal(t, "hello", data["message"])
+		assert.Equal(t, "channel", data["channel_id"])
+	})
+
+	for name, tc := range map[string]struct {
+		status    int
+		expected  PushResponse
+		attempted int
+	}{
+		"gone":          {http.StatusGone, NewRemovePushResponseWithReason("WEBPUSH_GONE"), 1},
+		"not found":     {http.StatusNotFound, NewRemovePushResponseWithReason("WEBPUSH_NOT_FOUND"), 1},
+		"unauthorized":  {http.StatusUnauthorized, NewErrorPushResponseWithReason("unknown send response error", "WEBPUSH_UNAUTHORIZED", false), 1},
+		"rate limited":  {http.StatusTooManyRequests, NewErrorPushResponseWithReason("unknown send response error", "WEBPUSH_TOO_MANY_REQUESTS", true), MAX_RETRIES},
+		"service error": {http.StatusInternalServerError, NewErrorPushResponseWithReason("unknown send response error", "WEBPUSH_INTERNAL_SERVER_ERROR", true), MAX_RETRIES},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := "/push/" + strings.ReplaceAll(name, " ", "-")
+			mut.Lock()
+			statuses[path] = tc.status
+			received = nil
+			mut.Unlock()
+
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: subscription(path), Type: model.PushTypeMessage})
+			assert.Equal(t, tc.expected, resp)
+
+			mut.Lock()
+			defer mut.Unlock()
+			assert.Len(t, received, tc.attempted)
+		})
+	}
+
+	t.Run("invalid subscriptions are removed", func(t *testing.T) {
+		for _, deviceID := range []string{
+			"not-json",
+			`{"endpoint": "http://insecure.example.com/push", "keys": {"p256dh": "", "auth": ""}}`,
+			strings.Replace(subscription("/push/ok"), base64.RawURLEncoding.EncodeToString(authSecret), "c2hvcnQ", 1),
+			// 65 bytes, but not a point of the curve.
+			strings.Replace(subscription("/push/ok"), base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(append([]byte{4}, bytes.Repeat([]byte{1}, 64)...)), 1),
+		} {
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: deviceID, Type: model.PushTypeMessage})
+			assert.Equal(t, NewRemovePushResponseWithReason("WEBPUSH_INVALID_SUBSCRIPTION"), resp, deviceID)
+		}
+	})
+
+	t.Run("oversized payloads fail", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: subscription("/push/ok"), Type: model.PushTypeMessage, Message: strings.Repeat("a", WEBPUSH_RECORD_SIZE)})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "WEBPUSH_PAYLOAD_TOO_LARGE", resp[PUSH_REASON])
+	})
+
+	t.Run("endpoints on other hosts are rejected", func(t *testing.T) {
+		deviceID := strings.Replace(subscription("/push/ok"), pushService.URL, "https://metadata.internal", 1)
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: deviceID, Type: model.PushTypeMessage})
+		assert.Equal(t, NewErrorPushResponseWithReason("web push host is not allowed", "WEBPUSH_HOST_NOT_ALLOWED", false), resp)
+	})
+
+	t.Run("redirects are not followed", func(t *testing.T) {
+		mut.Lock()
+		statuses["/push/redirect"] = http.StatusFound
+		received = nil
+		mut.Unlock()
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: subscription("/push/redirect"), Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+
+		mut.Lock()
+		defer mut.Unlock()
+		assert.Len(t, received, 1)
+	})
+}
@@ -0,0 +1,301 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kyokomi/emoji"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+const (
+	// PUSH_NOTIFY_WNS is the platform of WNS targets in metrics and health
+	// reports.
+	PUSH_NOTIFY_WNS    = "wns"
+	WNS_TOKEN_ENDPOINT = "https://login.live.com/accesstoken.srf"
+	WNS_TOKEN_SCOPE    = "notify.windows.com"
+	WNS_CHANNEL_HOST   = "*.notify.windows.com"
+	WNS_TYPE_RAW       = "wns/raw"
+	WNS_TYPE_TOAST     = "wns/toast"
+)
+
+// wnsToast is the XML payload of toast notifications.
+type wnsToast struct {
+	XMLName xml.Name `xml:"toast"`
+	// Launch is passed to the app when the toast is clicked.
+	Launch  string `xml:"launch,attr"`
+	Binding struct {
+		Template string   `xml:"template,attr"`
+		Texts    []string `xml:"text"`
+	} `xml:"visual>binding"`
+}
+
+// WNSNotificationServer delivers notifications to Windows apps through the
+// Windows Notification Service.
+type WNSNotificationServer struct {
+	metrics         *metrics
+	logger          *mlog.Logger
+	WNSPushSettings WNSPushSettings
+	client          *http.Client
+	token           *clientCredentialsToken
+	channelHosts    []string
+	sendTimeout     time.Duration
+	retryTimeout    time.Duration
+}
+
+func NewWNSNotificationServer(settings WNSPushSettings, logger *mlog.Logger, metrics *metrics, sendTimeoutSecs int, retryTimeoutSecs int) *WNSNotificationServer {
+	return &WNSNotificationServer{
+		WNSPushSettings: settings,
+		metrics:         metrics,
+		logger:          logger,
+		sendTimeout:     time.Duration(sendTimeoutSecs) * time.Second,
+		retryTimeout:    time.Duration(retryTimeoutSecs) * time.Second,
+	}
+}
+
+func (me *WNSNotificationServer) Initialize() error {
+	me.logger.Info("Initializing wns notification server", mlog.String("type", me.WNSPushSettings.Type))
+
+	if me.WNSPushSettings.WNSPackageSID == "" || me.WNSPushSettings.WNSClientSecret == "" {
+		return fmt.Errorf("wns push notifications not configured: missing WNSPackageSID or WNSClientSecret for type=%v", me.WNSPushSettings.Type)
+	}
+
+	me.client = &http.Client{}
+	if me.WNSPushSettings.WNSCAFile != "" {
+		rootCAs, err := loadCertPool(me.WNSPushSettings.WNSCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load WNSCAFile for type=%v: %v", me.WNSPushSettings.Type, err)
+		}
+		me.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		}
+	}
+
+	me.channelHosts = []string{WNS_CHANNEL_HOST}
+	if len(me.WNSPushSettings.WNSChannelHosts) > 0 {
+		me.channelHosts = me.WNSPushSettings.WNSChannelHosts
+		me.logger.Info("Sending wns notifications to custom channel hosts", mlog.String("type", me.WNSPushSettings.Type), mlog.Any("hosts", me.channelHosts))
+	}
+
+	tokenURL := WNS_TOKEN_ENDPOINT
+	if me.WNSPushSettings.WNSTokenEndpoint != "" {
+		tokenURL = me.WNSPushSettings.WNSTokenEndpoint
+	}
+	me.token = newClientCredentialsToken(me.client, tokenURL, url.Values{
+		"client_id":     {me.WNSPushSettings.WNSPackageSID},
+		"client_secret": {me.WNSPushSettings.WNSClientSecret},
+		"scope":         {WNS_TOKEN_SCOPE},
+	})
+	return nil
+}
+
+// render returns the WNS notification type, content type and body of msg.
+// Messages are shown as toasts, launching the app with the same data map as
+// on Android, and other notifications are raw notifications carrying that
+// data map for the app to handle.
+func (me *WNSNotificationServer) render(msg *model.PushNotification) (string, string, []byte, error) {
+	data, err := json.Marshal(notificationData(msg))
+	if err != nil {
+		return "", "", nil, err
+	}
+	if msg.Type != model.PushTypeMessage && msg.Type != model.PushTypeSession {
+		return WNS_TYPE_RAW, "application/octet-stream", data, nil
+	}
+
+	toast := wnsToast{Launch: string(data)}
+	toast.Binding.Template = "ToastGeneric"
+	if msg.ChannelName != "" && !msg.IsIdLoaded {
+		toast.Binding.Texts = append(toast.Binding.Texts, msg.ChannelName)
+	}
+	toast.Binding.Texts = append(toast.Binding.Texts, emoji.Sprint(msg.Message))
+	body, err := xml.Marshal(toast)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return WNS_TYPE_TOAST, "text/xml", body, nil
+}
+
+func (me *WNSNotificationServer) SendNotification(_ int, msg *model.PushNotification) PushResponse {
+	pushType := msg.Type
+	if me.metrics != nil {
+		me.metrics.incrementNotificationTotal(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard)
+	}
+
+	channel, err := url.Parse(msg.DeviceId)
+	if err != nil || channel.Host == "" || channel.Scheme != "https" {
+		me.logger.Info(
+			"Failed to parse wns channel sending remove code",
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.String("type", me.WNSPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, "InvalidChannel")
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("WNS", "INVALID_CHANNEL"))
+	}
+	if !matchesHostPattern(channel.Hostname(), me.channelHosts) {
+		me.logger.Warn(
+			"Did not send wns push to a host that is not allowed",
+			mlog.String("host", channel.Hostname()),
+			mlog.String("sid", msg.ServerId),
+			mlog.String("type", me.WNSPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, "HostNotAllowed")
+		}
+		return NewErrorPushResponseWithReason("wns host is not allowed", upstreamReason("WNS", "HOST_NOT_ALLOWED"), false)
+	}
+
+	wnsType, contentType, body, err := me.render(msg)
+	if err != nil {
+		return NewErrorPushResponse(err.Error())
+	}
+
+	me.logger.Info(
+		"Sending wns push notification",
+		mlog.String("device", me.WNSPushSettings.Type),
+		mlog.String("type", msg.Type),
+		mlog.String("wns_type", wnsType),
+		mlog.String("ack_id", msg.AckId),
+	)
+	res, err := me.SendNotificationWithRetry(channel.String(), wnsType, contentType, body)
+	if err != nil {
+		me.logger.Error(
+			"Failed to send wns push",
+			mlog.String("sid", msg.ServerId),
+			mlog.String("did", redactToken(msg.DeviceId)),
+			mlog.Err(err),
+			mlog.String("type", me.WNSPushSettings.Type),
+		)
+		if errors.Is(err, errAccessToken) {
+			if me.metrics != nil {
+				me.metrics.incrementFailure(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, tokenSourceError)
+			}
+			return NewErrorPushResponseWithReason(err.Error(), upstreamReason("WNS", tokenSourceError), false)
+		}
+		if me.metrics != nil {
+			me.metrics.incrementFailure(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, "RequestError")
+		}
+		return NewErrorPushResponseWithReason("unknown transport error", transportErrorReason(err), true)
+	}
+
+	reason := wnsReason(res)
+	switch {
+	case res.StatusCode == http.StatusOK && res.Header.Get("X-WNS-Status") != "channelthrottled":
+		// Notifications the device dropped, e.g. toasts the user disabled,
+		// were still delivered as far as the proxy is concerned.
+		if me.metrics != nil {
+			if msg.AckId != "" {
+				me.metrics.incrementSuccessWithAck(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard)
+			} else {
+				me.metrics.incrementSuccess(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard)
+			}
+		}
+		return NewOkPushResponse()
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		// The channel URI is not valid or has expired, the app requests a
+		// new one when it starts.
+		me.logger.Info(
+			"Failed to send wns push sending remove code res",
+			mlog.Int("code", res.StatusCode),
+			mlog.String("error", res.Header.Get("X-WNS-Error-Description")),
+			mlog.String("msgId", res.Header.Get("X-WNS-Msg-ID")),
+			mlog.String("type", me.WNSPushSettings.Type),
+		)
+		if me.metrics != nil {
+			me.metrics.incrementRemoval(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, reason)
+		}
+		return NewRemovePushResponseWithReason(upstreamReason("WNS", reason))
+	}
+
+	me.logger.Error(
+		"Failed to send wns push with res",
+		mlog.String("sid", msg.ServerId),
+		mlog.String("did", redactToken(msg.DeviceId)),
+		mlog.Int("code", res.StatusCode),
+		mlog.String("status", res.Header.Get("X-WNS-Status")),
+		mlog.String("error", res.Header.Get("X-WNS-Error-Description")),
+		mlog.String("msgId", res.Header.Get("X-WNS-Msg-ID")),
+		mlog.String("type", me.WNSPushSettings.Type),
+	)
+	if me.metrics != nil {
+		me.metrics.incrementFailure(PUSH_NOTIFY_WNS, pushType, model.PushTransportStandard, reason)
+	}
+	return NewErrorPushResponseWithReason("unknown send response error", upstreamReason("WNS", reason), isRetryableWNSResponse(res))
+}
+
+func (me *WNSNotificationServer) SendNotificationWithRetry(channel, wnsType, contentType string, body []byte) (*http.Response, error) {
+	var res *http.Response
+	err := retryWithBackoff(me.logger, me.metrics, PUSH_NOTIFY_WNS, me.sendTimeout, me.retryTimeout, func(ctx context.Context) (bool, error) {
+		var err error
+		res, err = me.push(ctx, channel, wnsType, contentType, body)
+		if err == nil && res.StatusCode == http.StatusUnauthorized {
+			// The access token expired or was revoked, a new one is
+			// requested by the next attempt.
+			me.token.reset()
+			return true, nil
+		}
+		return !errors.Is(err, errAccessToken) && (err != nil || isRetryableWNSResponse(res)), err
+	})
+	return res, err
+}
+
+// push posts a notification to a channel URI. The body of the returned
+// response is already closed, only its status and headers are relevant.
+func (me *WNSNotificationServer) push(ctx context.Context, channel, wnsType, contentType string, body []byte) (*http.Response, error) {
+	accessToken, err := me.token.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, channel, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-WNS-Type", wnsType)
+	req.Header.Set("X-WNS-RequestForStatus", "true")
+
+	res, err := me.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	return res, nil
+}
+
+// wnsReason names the failure of a WNS response.
+func wnsReason(res *http.Response) string {
+	switch {
+	case res.StatusCode == http.StatusGone:
+		return "CHANNEL_EXPIRED"
+	case res.StatusCode == http.StatusNotAcceptable || res.Header.Get("X-WNS-Status") == "channelthrottled":
+		return "CHANNEL_THROTTLED"
+	case res.StatusCode == http.StatusUnauthorized && strings.Contains(res.Header.Get("WWW-Authenticate"), "Token expired"):
+		return "TOKEN_EXPIRED"
+	}
+	return httpStatusReason(res.StatusCode)
+}
+
+// isRetryableWNSResponse reports whether sending the same notification again
+// later may succeed.
+func isRetryableWNSResponse(res *http.Response) bool {
+	return res.StatusCode == http.StatusNotAcceptable || res.Header.Get("X-WNS-Status") == "channelthrottled" || isRetryableHTTPStatus(res.StatusCode)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2015 Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package server
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/shared/mlog"
+)
+
+func TestWNSNotificationServer(t *testing.T) {
+	logger, err := mlog.NewLogger()
+	require.NoError(t, err)
+
+	type received struct {
+		wnsType     string
+		contentType string
+		body        []byte
+	}
+
+	var mut sync.Mutex
+	tokensIssued := 0
+	var notifications []received
+	replies := map[string][]int{}
+	wns := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		if r.URL.Path == "/accesstoken.srf" {
+			require.NoError(t, r.ParseForm())
+			w.Header().Set("Content-Type", "application/json")
+			if r.PostForm.Get("client_id") != "ms-app://s-1-15-2-1" || r.PostForm.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_client", "error_description": "Invalid client id"})
+				return
+			}
+			assert.Equal(t, WNS_TOKEN_SCOPE, r.PostForm.Get("scope"))
+			tokensIssued++
+			_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "token", "expires_in": 86400, "token_type": "bearer"})
+			return
+		}
+
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		notifications = append(notifications, received{r.Header.Get("X-WNS-Type"), r.Header.Get("Content-Type"), body})
+
+		channel := strings.TrimPrefix(r.URL.Path, "/")
+		if scripted := replies[channel]; len(scripted) > 0 {
+			replies[channel] = scripted[1:]
+			if scripted[0] == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request",error_description="Token expired"`)
+			}
+			w.WriteHeader(scripted[0])
+			return
+		}
+		w.Header().Set("X-WNS-Status", "received")
+	}))
+	defer wns.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: wns.Certificate().Raw}), 0600))
+
+	newServer := func(secret string) *WNSNotificationServer {
+		srv := NewWNSNotificationServer(WNSPushSettings{
+			Type:             "windows",
+			WNSPackageSID:    "ms-app://s-1-15-2-1",
+			WNSClientSecret:  secret,
+			WNSTokenEndpoint: wns.URL + "/accesstoken.srf",
+			WNSChannelHosts:  []string{"127.0.0.1"},
+			WNSCAFile:        caFile,
+		}, logger, nil, 10, 2)
+		require.NoError(t, srv.Initialize())
+		return srv
+	}
+	srv := newServer("secret")
+
+	t.Run("messages are sent as toasts", func(t *testing.T) {
+		mut.Lock()
+		notifications = nil
+		mut.Unlock()
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: wns.URL + "/toast", Type: model.PushTypeMessage, Message: "hello :smile:", ChannelName: "town square", ChannelId: "channel"})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		require.Len(t, notifications, 1)
+		assert.Equal(t, WNS_TYPE_TOAST, notifications[0].wnsType)
+		assert.Equal(t, "text/xml", notifications[0].contentType)
+
+		var toast wnsToast
+		require.NoError(t, xml.Unmarshal(notifications[0].body, &toast))
+		assert.Equal(t, "ToastGeneric", toast.Binding.Template)
+		assert.Equal(t, []string{"town square", "hello 😄 "}, toast.Binding.Texts)
+
+		var data map[string]string
+		require.NoError(t, json.Unmarshal([]byte(toast.Launch), &data))
+		assert.Equal(t, "channel", data["channel_id"])
+		assert.Equal(t, model.PushTypeMessage, data["type"])
+	})
+
+	t.Run("other notifications are sent as raw notifications", func(t *testing.T) {
+		mut.Lock()
+		notifications = nil
+		mut.Unlock()
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: wns.URL + "/raw", Type: model.PushTypeClear, ChannelId: "channel", Badge: 3})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		require.Len(t, notifications, 1)
+		assert.Equal(t, WNS_TYPE_RAW, notifications[0].wnsType)
+		assert.Equal(t, "application/octet-stream", notifications[0].contentType)
+
+		var data map[string]string
+		require.NoError(t, json.Unmarshal(notifications[0].body, &data))
+		assert.Equal(t, model.PushTypeClear, data["type"])
+		assert.Equal(t, "3", data["badge"])
+	})
+
+	t.Run("expired access tokens are renewed", func(t *testing.T) {
+		mut.Lock()
+		issued := tokensIssued
+		replies["renew"] = []int{http.StatusUnauthorized}
+		mut.Unlock()
+
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: wns.URL + "/renew", Type: model.PushTypeMessage})
+		assert.Equal(t, NewOkPushResponse(), resp)
+
+		mut.Lock()
+		defer mut.Unlock()
+		assert.Equal(t, issued+1, tokensIssued)
+	})
+
+	for name, tc := range map[string]struct {
+		status   int
+		expected PushResponse
+	}{
+		"expired":   {http.StatusGone, NewRemovePushResponseWithReason("WNS_CHANNEL_EXPIRED")},
+		"not-found": {http.StatusNotFound, NewRemovePushResponseWithReason("WNS_NOT_FOUND")},
+		"forbidden": {http.StatusForbidden, NewErrorPushResponseWithReason("unknown send response error", "WNS_FORBIDDEN", false)},
+		"too-large": {http.StatusRequestEntityTooLarge, NewErrorPushResponseWithReason("unknown send response error", "WNS_REQUEST_ENTITY_TOO_LARGE", false)},
+		"throttled": {http.StatusNotAcceptable, NewErrorPushResponseWithReason("unknown send response error", "WNS_CHANNEL_THROTTLED", true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mut.Lock()
+			replies[name] = []int{tc.status, tc.status, tc.status}
+			mut.Unlock()
+
+			assert.Equal(t, tc.expected, srv.SendNotification(2, &model.PushNotification{DeviceId: wns.URL + "/" + name, Type: model.PushTypeMessage}))
+		})
+	}
+
+	t.Run("invalid channels are removed", func(t *testing.T) {
+		for _, deviceID := range []string{"not a channel", "http://127.0.0.1/channel"} {
+			resp := srv.SendNotification(2, &model.PushNotification{DeviceId: deviceID, Type: model.PushTypeMessage})
+			assert.Equal(t, NewRemovePushResponseWithReason("WNS_INVALID_CHANNEL"), resp, deviceID)
+		}
+	})
+
+	t.Run("channels on other hosts are rejected", func(t *testing.T) {
+		resp := srv.SendNotification(2, &model.PushNotification{DeviceId: "https://metadata.internal/latest", Type: model.PushTypeMessage})
+		assert.Equal(t, NewErrorPushResponseWithReason("wns host is not allowed", "WNS_HOST_NOT_ALLOWED", false), resp)
+	})
+
+	t.Run("rejected client credentials", func(t *testing.T) {
+		resp := newServer("wrong").SendNotification(2, &model.PushNotification{DeviceId: wns.URL + "/toast", Type: model.PushTypeMessage})
+		assert.Equal(t, PUSH_STATUS_FAIL, resp[PUSH_STATUS])
+		assert.Equal(t, "WNS_TOKEN_SOURCE_ERROR", resp[PUSH_REASON])
+	})
+}